@@ -194,6 +194,78 @@ const docTemplate_swagger = `{
                     }
                 }
             },
+            "options": {
+                "description": "Redirect request.",
+                "consumes": [
+                    "*/*"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "router redirect"
+                ],
+                "summary": "Redirect request to healthy server",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "204": {
+                        "description": "No Content",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "head": {
+                "description": "Redirect request.",
+                "consumes": [
+                    "*/*"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "router redirect"
+                ],
+                "summary": "Redirect request to healthy server",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "204": {
+                        "description": "No Content",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
             "patch": {
                 "description": "Redirect request.",
                 "consumes": [
@@ -230,6 +302,22 @@ const docTemplate_swagger = `{
                     }
                 }
             }
+        },
+        "/{package.Service}/{Method}": {
+            "post": {
+                "description": "Routes the gRPC calls (/package.Service/Method) by the service, with the pools of grpc_services.",
+                "consumes": [
+                    "application/grpc"
+                ],
+                "produces": [
+                    "application/grpc"
+                ],
+                "tags": [
+                    "router redirect"
+                ],
+                "summary": "Redirect gRPC call to healthy server",
+                "responses": {}
+            }
         }
     }
 }`
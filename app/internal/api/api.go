@@ -3,9 +3,10 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"runtime/debug"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/ortisan/router-go/docs"
@@ -70,9 +71,18 @@ func HealthCheck(c *gin.Context) {
 // @Router /api/{prefix_service}/{backend_api_service} [put]
 // @Router /api/{prefix_service}/{backend_api_service} [patch]
 // @Router /api/{prefix_service}/{backend_api_service} [delete]
+// @Router /api/{prefix_service}/{backend_api_service} [head]
+// @Router /api/{prefix_service}/{backend_api_service} [options]
 func HandleRequest(c *gin.Context) {
 
 	resource := c.Param("resource")
+	if resource == "" { // Methods without route, like PROPFIND
+		resource = strings.TrimPrefix(c.Request.URL.Path, "/api")
+	}
+	resource, err := loadbalancer.NormalizePath(resource)
+	if err != nil {
+		panic(err)
+	}
 	apiPaths := strings.Split(resource, "/")
 
 	r := c.Request
@@ -87,19 +97,100 @@ func HandleRequest(c *gin.Context) {
 		panic(errApp.NewBadRequestError(fmt.Sprintf("Cannot any server that can handle the prefix \"%s\"", servicePrefix)))
 	}
 
-	retries := loadbalancer.GetRetryFromContext(r)
+	// Retries are done by server pool, with the retry policy of the prefix
+	err = serverPool.HandleRequest(c, strings.TrimPrefix(resource, "/"+servicePrefix), r.Method, r.Header)
+	if err != nil {
+		panic(err)
+	}
+}
 
-	if retries < loadbalancer.MaxRetries {
-		select {
-		case <-time.After(loadbalancer.BackoffTimeout):
-			err := serverPool.HandleRequest(c, util.GetSubstringAfter(resource, servicePrefix), r.Method, r.Header)
-			if err != nil {
-				panic(err)
-			}
+// Route gRPC calls to the pool of the service
+// @Summary Redirect gRPC call to healthy server
+// @Description Routes the gRPC calls (/package.Service/Method) by the service, with the pools of grpc_services.
+// @Tags router redirect
+// @Accept application/grpc
+// @Produce application/grpc
+// @Router /{package.Service}/{Method} [post]
+func HandleGrpcRequest(c *gin.Context) {
+	r := c.Request
+	if !loadbalancer.IsGrpc(r.Header) {
+		return // Not found
+	}
+
+	serviceName, ok := loadbalancer.GrpcServiceName(r.URL.Path)
+	if !ok {
+		writeGrpcError(c, loadbalancer.GrpcStatusUnimplemented, "Path of gRPC call must be /{package.Service}/{Method}")
+		return
+	}
+	servicePrefix, ok := loadbalancer.GrpcServicePrefix(config.ConfigObj.GrpcServices, serviceName)
+	if !ok {
+		writeGrpcError(c, loadbalancer.GrpcStatusUnimplemented, fmt.Sprintf("Cannot any server that can handle the service \"%s\"", serviceName))
+		return
+	}
+	serverPool := loadbalancer.ServerPoolsObj.GetServerPoolByPrefix(servicePrefix)
+	if serverPool == nil {
+		writeGrpcError(c, loadbalancer.GrpcStatusUnavailable, fmt.Sprintf("Cannot any server that can handle the prefix \"%s\"", servicePrefix))
+		return
+	}
+
+	if err := serverPool.HandleRequest(c, r.URL.Path, r.Method, r.Header); err != nil {
+		code := loadbalancer.GrpcStatusUnavailable
+		if appErr, ok := err.(errApp.IWithMessageAndStatusCode); ok && appErr.Status() == http.StatusGatewayTimeout {
+			code = loadbalancer.GrpcStatusDeadlineExceeded
 		}
+		writeGrpcError(c, code, err.Error())
 	}
 }
 
+// RouteTable sends the requests that match a route of the table to its pool, with the path of the service (see
+// loadbalancer.ServicePath). The other requests are routed by the prefix. The routes of the router itself (health
+// check, metrics, swagger) are never routed by the table.
+func RouteTable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if loadbalancer.RouteTableObj.Empty() {
+			c.Next()
+			return
+		}
+		r := c.Request
+		path, err := loadbalancer.NormalizePath(r.URL.Path)
+		if err != nil {
+			panic(err)
+		}
+		servicePrefix, ok := loadbalancer.RouteTableObj.Match(r, path)
+		if !ok {
+			c.Next()
+			return
+		}
+		c.Abort()
+
+		serverPool := loadbalancer.ServerPoolsObj.GetServerPoolByPrefix(servicePrefix)
+		if serverPool == nil {
+			panic(errApp.NewBadRequestError(fmt.Sprintf("Cannot any server that can handle the prefix \"%s\"", servicePrefix)))
+		}
+		if err := serverPool.HandleRequest(c, loadbalancer.ServicePath(servicePrefix, path), r.Method, r.Header); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// HandleNoRoute routes the gRPC calls and the requests to /api with methods that gin doesn't route, like PROPFIND
+func HandleNoRoute(c *gin.Context) {
+	if !loadbalancer.IsGrpc(c.Request.Header) && strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		HandleRequest(c)
+		return
+	}
+	HandleGrpcRequest(c)
+}
+
+// writeGrpcError answers the gRPC call with the status into the headers (trailers only response)
+func writeGrpcError(c *gin.Context, code int, message string) {
+	c.Header(constant.ContentTypeHeaderName, "application/grpc")
+	c.Header(loadbalancer.GrpcStatusHeaderName, strconv.Itoa(code))
+	c.Header(loadbalancer.GrpcMessageHeaderName, url.PathEscape(message))
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+}
+
 func Setup() *gin.Engine {
 	r := gin.Default()
 
@@ -108,14 +199,11 @@ func Setup() *gin.Engine {
 	r.Use(ErrorHandler())                                // Error handling
 	r.Use(gin.Logger())                                  // Logger request/response
 
-	// Routes
-	r.GET("/", HealthCheck)                          // HealthCheck
-	r.GET("/metrics", gin.WrapH(promhttp.Handler())) // Prometheus metrics
-	r.GET("/api/*resource", HandleRequest)           // By Pass
-	r.POST("/api/*resource", HandleRequest)          // By Pass
-	r.PUT("/api/*resource", HandleRequest)           // By Pass
-	r.PATCH("/api/*resource", HandleRequest)         // By Pass
-	r.DELETE("/api/*resource", HandleRequest)        // By Pass
+	// Routes. The route table comes before the routes by prefix, only on the proxied paths.
+	r.GET("/", HealthCheck)                              // HealthCheck
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))     // Prometheus metrics
+	r.Any("/api/*resource", RouteTable(), HandleRequest) // By Pass, all methods
+	r.NoRoute(RouteTable(), HandleNoRoute)               // gRPC calls by service and other methods
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler,
 		ginSwagger.URL("http://localhost:8080/swagger/doc.json"),
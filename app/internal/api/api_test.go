@@ -1,11 +1,17 @@
 package api
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/ortisan/router-go/internal/config"
+	"github.com/ortisan/router-go/internal/loadbalancer"
 )
 
 func TestMetricsRoute(t *testing.T) {
@@ -17,3 +23,93 @@ func TestMetricsRoute(t *testing.T) {
 
 	assert.Equal(t, 200, w.Code)
 }
+
+func TestServerH2C(t *testing.T) {
+	config.ConfigObj.App.H2C = true
+	defer func() { config.ConfigObj.App.H2C = false }()
+	srv, err := NewServer(Setup())
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(srv.Handler)
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(server.URL + "/")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
+
+func TestGrpcRouteUnknownService(t *testing.T) {
+	router := Setup()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/unknown.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "12", w.Header().Get("Grpc-Status"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/unknown", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestAllMethodsRouted(t *testing.T) {
+	router := Setup()
+
+	// Routed to the pools, which don't exist for the prefix
+	for _, method := range []string{"HEAD", "OPTIONS", "PROPFIND"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/unknown/resource", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 400, w.Code, method)
+	}
+}
+
+func TestPathTraversalRejected(t *testing.T) {
+	router := Setup()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/app1/%2e%2e/admin", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "can't have .. segments")
+}
+
+func TestRouteTable(t *testing.T) {
+	routeTable, _ := loadbalancer.NewRouteTable([]config.Route{{Hosts: []string{"admin.example.com"}, ServicePrefix: "unknown"}})
+	loadbalancer.RouteTableObj = routeTable
+	defer func() { loadbalancer.RouteTableObj = &loadbalancer.RouteTable{} }()
+	router := Setup()
+
+	// Matched by the table, without pool for the prefix
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://admin.example.com/users", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	// Other hosts keep the routes by prefix
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://api.example.com/api/other/users", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "Cannot any server that can handle the prefix \\\"other\\\"")
+
+	// The routes of the router aren't routed by the table, even with a catch-all route
+	routeTable, _ = loadbalancer.NewRouteTable([]config.Route{{Path: config.RoutePath{Type: loadbalancer.RoutePathPrefix, Value: "/"}, ServicePrefix: "unknown"}})
+	loadbalancer.RouteTableObj = routeTable
+	for _, path := range []string{"/", "/metrics"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code, path)
+	}
+}
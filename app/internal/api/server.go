@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+// NewServer returns the server of the router. HTTP/2 is served over TLS and, when h2c is enabled, over plain text
+// connections too, with prior knowledge or upgrade.
+func NewServer(r *gin.Engine) (*http.Server, error) {
+	h2Server := &http2.Server{}
+	var handler http.Handler = r
+	if config.ConfigObj.App.H2C {
+		handler = h2c.NewHandler(r, h2Server)
+	}
+	srv := &http.Server{Addr: config.ConfigObj.App.ServerAddress, Handler: handler}
+	if err := http2.ConfigureServer(srv, h2Server); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// ListenAndServe runs the server with TLS when the certificate is set
+func ListenAndServe(srv *http.Server) error {
+	if config.ConfigObj.App.TLSCertFile != "" {
+		return srv.ListenAndServeTLS(config.ConfigObj.App.TLSCertFile, config.ConfigObj.App.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
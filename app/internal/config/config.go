@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,11 +16,20 @@ type Config struct {
 	OpenTelemetry OpenTelemetry `mapstructure:"opentelemetry"`
 	AWS           AWS           `mapstructure:"aws"`
 	Servers       []Server      `mapstructure:"servers"`
+	Services      []Service     `mapstructure:"services"`
+	GrpcServices  []GrpcService `mapstructure:"grpc_services"`
+	Routes        []Route       `mapstructure:"routes"`
 }
 
 type App struct {
 	Name          string `mapstructure:"name"`
 	ServerAddress string `mapstructure:"server_address"`
+	ZoneAws       string `mapstructure:"zone_aws"`
+	TLSCertFile   string `mapstructure:"tls_cert_file"`
+	TLSKeyFile    string `mapstructure:"tls_key_file"`
+	H2C           bool   `mapstructure:"h2c"`
+	// Time to finish the requests and tunnels in flight when the router stops
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
 }
 
 type Etcd struct {
@@ -66,10 +77,225 @@ type Server struct {
 	ServerName    string      `mapstructure:"server_name"`
 	EndpointUrl   string      `mapstructure:"endpoint_url"`
 	ZoneAws       string      `mapstructure:"zone_aws"`
+	Weight        int         `mapstructure:"weight"`
+	Priority      int         `mapstructure:"priority"`
 	Alive         bool        `mapstructure:"alive"`
 	HealthCheck   HealthCheck `mapstructure:"healthcheck"`
 }
 
+type HashKey struct {
+	Type string `mapstructure:"type"`
+	Name string `mapstructure:"name"`
+}
+
+type StickySession struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	CookieName string        `mapstructure:"cookie_name"`
+	TTL        time.Duration `mapstructure:"ttl"`
+	Path       string        `mapstructure:"path"`
+	Domain     string        `mapstructure:"domain"`
+	Secure     bool          `mapstructure:"secure"`
+	HttpOnly   bool          `mapstructure:"http_only"`
+	SameSite   string        `mapstructure:"same_site"`
+	// Key that signs the affinity cookies, the same for all routers. Empty takes a random key by router instance.
+	Secret string `mapstructure:"secret"`
+}
+
+type ZoneAware struct {
+	Enabled            bool    `mapstructure:"enabled"`
+	MinHealthyFraction float64 `mapstructure:"min_healthy_fraction"`
+}
+
+type SlowStart struct {
+	Window            time.Duration `mapstructure:"window"`
+	MinWeightFraction float64       `mapstructure:"min_weight_fraction"`
+	Aggression        float64       `mapstructure:"aggression"`
+}
+
+type OutlierDetection struct {
+	Enabled                   bool          `mapstructure:"enabled"`
+	Interval                  time.Duration `mapstructure:"interval"`
+	Consecutive5xx            uint32        `mapstructure:"consecutive_5xx"`
+	ConsecutiveGatewayFailure uint32        `mapstructure:"consecutive_gateway_failure"`
+	SuccessRateMinimumHosts   int           `mapstructure:"success_rate_minimum_hosts"`
+	SuccessRateRequestVolume  uint32        `mapstructure:"success_rate_request_volume"`
+	SuccessRateStdevFactor    float64       `mapstructure:"success_rate_stdev_factor"`
+	BaseEjectionTime          time.Duration `mapstructure:"base_ejection_time"`
+	MaxEjectionTime           time.Duration `mapstructure:"max_ejection_time"`
+	MaxEjectionPercent        int           `mapstructure:"max_ejection_percent"`
+}
+
+type CircuitBreaker struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	ConsecutiveFailures uint32        `mapstructure:"consecutive_failures"`
+	FailureRatio        float64       `mapstructure:"failure_ratio"`
+	Window              time.Duration `mapstructure:"window"`
+	MinRequests         uint32        `mapstructure:"min_requests"`
+	OpenTimeout         time.Duration `mapstructure:"open_timeout"`
+	HalfOpenMaxRequests uint32        `mapstructure:"half_open_max_requests"`
+}
+
+type Retry struct {
+	MaxAttempts          int           `mapstructure:"max_attempts"`
+	BackoffBase          time.Duration `mapstructure:"backoff_base"`
+	BackoffMax           time.Duration `mapstructure:"backoff_max"`
+	RetryOn              []string      `mapstructure:"retry_on"`
+	RetriableStatusCodes []int         `mapstructure:"retriable_status_codes"`
+	RetryNonIdempotent   bool          `mapstructure:"retry_non_idempotent"`
+	MaxBufferedBodyBytes int64         `mapstructure:"max_buffered_body_bytes"`
+}
+
+type RetryBudget struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	Percent             float64       `mapstructure:"percent"`
+	MinRetriesPerSecond int           `mapstructure:"min_retries_per_second"`
+	TTL                 time.Duration `mapstructure:"ttl"`
+}
+
+type Hedging struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	Delay              time.Duration `mapstructure:"delay"`
+	DelayPercentile    float64       `mapstructure:"delay_percentile"`
+	BudgetPercent      float64       `mapstructure:"budget_percent"`
+	MinHedgesPerSecond int           `mapstructure:"min_hedges_per_second"`
+}
+
+type Timeouts struct {
+	Connect        time.Duration `mapstructure:"connect"`
+	ResponseHeader time.Duration `mapstructure:"response_header"`
+	Idle           time.Duration `mapstructure:"idle"`
+	Request        time.Duration `mapstructure:"request"`
+	HealthCheck    time.Duration `mapstructure:"health_check"`
+}
+
+type TLS struct {
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	ServerName         string `mapstructure:"server_name"`
+	MinVersion         string `mapstructure:"min_version"`
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+}
+
+type Transport struct {
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`
+	KeepAlive           time.Duration `mapstructure:"keep_alive"`
+	MaxConnLifetime     time.Duration `mapstructure:"max_conn_lifetime"`
+	// Protocol to the backends: auto, http1, h2 (over TLS) or h2c
+	Protocol string `mapstructure:"protocol"`
+	TLS      TLS    `mapstructure:"tls"`
+}
+
+type WebSocket struct {
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+}
+
+// GrpcService routes the calls of a gRPC service (package.Service, or package.* for all services of the package)
+type GrpcService struct {
+	Service       string `mapstructure:"service"`
+	ServicePrefix string `mapstructure:"service_prefix"`
+}
+
+type RoutePath struct {
+	// exact, prefix or regex
+	Type  string `mapstructure:"type"`
+	Value string `mapstructure:"value"`
+}
+
+// RouteValue matches a header or query parameter, with any value when both value and regex are empty
+type RouteValue struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+	Regex string `mapstructure:"regex"`
+}
+
+// Route sends the requests that match all its conditions to the pool of the service prefix. Empty conditions match all requests.
+// The pool gets the path after /api/{service prefix} when the request has it, like the routes by prefix, or the whole path.
+type Route struct {
+	// Hosts of the request, with a wildcard like *.example.com
+	Hosts         []string     `mapstructure:"hosts"`
+	Path          RoutePath    `mapstructure:"path"`
+	Methods       []string     `mapstructure:"methods"`
+	Headers       []RouteValue `mapstructure:"headers"`
+	Query         []RouteValue `mapstructure:"query"`
+	ServicePrefix string       `mapstructure:"service_prefix"`
+}
+
+type Streaming struct {
+	// Paths of the service that are always streamed (long-poll), besides the event streams
+	Paths       []string      `mapstructure:"paths"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+}
+
+// CORS policy of a service, answered by the router
+type CORS struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Origins allowed, * for all or with a wildcard like https://*.example.com
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+	// Request headers allowed, * for all
+	AllowedHeaders   []string      `mapstructure:"allowed_headers"`
+	ExposedHeaders   []string      `mapstructure:"exposed_headers"`
+	AllowCredentials bool          `mapstructure:"allow_credentials"`
+	MaxAge           time.Duration `mapstructure:"max_age"`
+}
+
+// RewriteRule changes the path sent to the backends
+type RewriteRule struct {
+	// strip_prefix, replace_prefix or regex
+	Type string `mapstructure:"type"`
+	// Prefix of the path, or the regular expression
+	Match string `mapstructure:"match"`
+	// New prefix, or the replacement of the regular expression with the capture groups ($1)
+	Replacement string `mapstructure:"replacement"`
+}
+
+type Rewrite struct {
+	// Rules applied in order to the path after the service prefix (see Route for the requests routed by the table)
+	Rules []RewriteRule `mapstructure:"rules"`
+	// Path prepended to the rewritten path, like /v2
+	BasePath string `mapstructure:"base_path"`
+}
+
+type Service struct {
+	ServicePrefix string        `mapstructure:"service_prefix"`
+	Strategy      string        `mapstructure:"strategy"`
+	EwmaDecay     time.Duration `mapstructure:"ewma_decay"`
+	// Response time of the backends without samples when no backend of the pool has one
+	EwmaInitialRtt   time.Duration    `mapstructure:"ewma_initial_rtt"`
+	HashKey          HashKey          `mapstructure:"hash_key"`
+	VirtualNodes     int              `mapstructure:"virtual_nodes"`
+	StickySession    StickySession    `mapstructure:"sticky_session"`
+	ZoneAware        ZoneAware        `mapstructure:"zone_aware"`
+	SlowStart        SlowStart        `mapstructure:"slow_start"`
+	OutlierDetection OutlierDetection `mapstructure:"outlier_detection"`
+	CircuitBreaker   CircuitBreaker   `mapstructure:"circuit_breaker"`
+	Retry            Retry            `mapstructure:"retry"`
+	RetryBudget      RetryBudget      `mapstructure:"retry_budget"`
+	Hedging          Hedging          `mapstructure:"hedging"`
+	Timeouts         Timeouts         `mapstructure:"timeouts"`
+	Transport        Transport        `mapstructure:"transport"`
+	WebSocket        WebSocket        `mapstructure:"websocket"`
+	Streaming        Streaming        `mapstructure:"streaming"`
+	CORS             CORS             `mapstructure:"cors"`
+	Rewrite          Rewrite          `mapstructure:"rewrite"`
+	// Client headers that aren't sent to the backends, Accept-Encoding when not set
+	HeadersDisabledInRedirection []string `mapstructure:"headers_disabled_in_redirection"`
+}
+
+// GetService returns the settings of a service prefix. Prefixes without settings get the defaults.
+func (c Config) GetService(servicePrefix string) Service {
+	for _, service := range c.Services {
+		if service.ServicePrefix == servicePrefix {
+			return service
+		}
+	}
+	return Service{ServicePrefix: servicePrefix}
+}
+
 func Setup() (config Config) {
 	viper.AddConfigPath(".")
 	viper.AddConfigPath("../internal/config/")
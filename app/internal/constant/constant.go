@@ -3,4 +3,6 @@ package constant
 const (
 	TraceIdHeaderName     = "x-trace-id"
 	ContentTypeHeaderName = "Content-Type"
+	RetryBudgetHeaderName = "x-retry-budget-exhausted"
+	DeadlineHeaderName    = "x-request-timeout-ms"
 )
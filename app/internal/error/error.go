@@ -92,3 +92,19 @@ type IntegrationError struct {
 func NewIntegrationError(msg string, cause error) error {
 	return IntegrationError{GenericError{ErrorSt{status: http.StatusInternalServerError, msg: msg, cause: cause, stackTrace: string(debug.Stack())}}}
 }
+
+type TimeoutError struct {
+	GenericError
+}
+
+func NewTimeoutError(msg string, cause error) error {
+	return TimeoutError{GenericError{ErrorSt{status: http.StatusGatewayTimeout, msg: msg, cause: cause, stackTrace: string(debug.Stack())}}}
+}
+
+type UnavailableError struct {
+	GenericError
+}
+
+func NewUnavailableError(msg string, cause error) error {
+	return UnavailableError{GenericError{ErrorSt{status: http.StatusServiceUnavailable, msg: msg, cause: cause, stackTrace: string(debug.Stack())}}}
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+)
+
+const (
+	StrategyRoundRobin     = "round_robin"
+	StrategyRandom         = "random"
+	StrategyWeighted       = "weighted"
+	StrategyLeastRequests  = "least_requests"
+	StrategyPeakEwma       = "peak_ewma"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// Balancer chooses the backend that will take a request among the healthy backends of a pool
+type Balancer interface {
+	Next(backends []*Backend, r *http.Request) *Backend
+}
+
+// NewBalancer returns the balancer of the strategy configured for the service prefix
+func NewBalancer(service config.Service) (Balancer, error) {
+	switch service.Strategy {
+	case "", StrategyRoundRobin:
+		return &RoundRobinBalancer{}, nil
+	case StrategyRandom:
+		return &RandomBalancer{}, nil
+	case StrategyWeighted:
+		return NewWeightedRoundRobinBalancer(), nil
+	case StrategyLeastRequests:
+		return &LeastRequestsBalancer{}, nil
+	case StrategyPeakEwma:
+		return NewPeakEwmaBalancer(service), nil
+	case StrategyConsistentHash:
+		return NewConsistentHashBalancer(service)
+	default:
+		return nil, errApp.NewGenericError(fmt.Sprintf("Unknown strategy \"%s\" for the prefix \"%s\"", service.Strategy, service.ServicePrefix), nil)
+	}
+}
+
+// RoundRobinBalancer takes the backends in turns
+type RoundRobinBalancer struct {
+	current uint64
+}
+
+// Next atomically increase the counter and return the backend of this index
+func (rr *RoundRobinBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint64(&rr.current, uint64(1)) % uint64(len(backends))
+	return backends[idx]
+}
+
+// RandomBalancer takes any backend with the same probability
+type RandomBalancer struct{}
+
+func (rb *RandomBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	return backends[rand.Intn(len(backends))]
+}
+
+// WeightedRoundRobinBalancer spreads the requests in proportion of the backend weights
+// using the smooth weighted round robin of nginx
+type WeightedRoundRobinBalancer struct {
+	currentWeights map[*Backend]int
+	mux            sync.Mutex
+}
+
+func NewWeightedRoundRobinBalancer() *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{currentWeights: make(map[*Backend]int)}
+}
+
+// Next raises the current weight of every backend by its weight and takes the highest one.
+// Only the given backends take part of the round, so the unhealthy ones keep the ratios of the others.
+func (wrr *WeightedRoundRobinBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	wrr.mux.Lock()
+	defer wrr.mux.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		wrr.currentWeights[b] += b.Weight
+		total += b.Weight
+		if best == nil || wrr.currentWeights[b] > wrr.currentWeights[best] {
+			best = b
+		}
+	}
+	wrr.currentWeights[best] -= total
+	return best
+}
+
+// LeastRequestsBalancer takes the backend with less requests in flight, breaking ties randomly
+type LeastRequestsBalancer struct{}
+
+func (lr *LeastRequestsBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	var least []*Backend
+	var min int64
+	for _, b := range backends {
+		active := b.ActiveRequests()
+		if len(least) == 0 || active < min {
+			least = []*Backend{b}
+			min = active
+		} else if active == min {
+			least = append(least, b)
+		}
+	}
+	if len(least) == 0 {
+		return nil
+	}
+	return least[rand.Intn(len(least))]
+}
+
+// PeakEwmaBalancer samples two backends and takes the one with the lower cost (power of two choices),
+// steering the traffic away from backends that are slow but still alive
+type PeakEwmaBalancer struct {
+	initialRtt time.Duration
+}
+
+func NewPeakEwmaBalancer(service config.Service) *PeakEwmaBalancer {
+	initialRtt := service.EwmaInitialRtt
+	if initialRtt <= 0 {
+		initialRtt = DefaultEwmaInitialRtt
+	}
+	return &PeakEwmaBalancer{initialRtt: initialRtt}
+}
+
+// seed returns the cost of the backends without response times: the mean of the others, or the initial rtt,
+// so a new or recovered backend doesn't win all the picks until its first response
+func (pe *PeakEwmaBalancer) seed(backends []*Backend) float64 {
+	var sum float64
+	var sampled int
+	for _, b := range backends {
+		if b.latency.Sampled() {
+			sum += b.latency.Value()
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return float64(pe.initialRtt)
+	}
+	return sum / float64(sampled)
+}
+
+func (pe *PeakEwmaBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	var seed float64
+	if !backends[i].latency.Sampled() || !backends[j].latency.Sampled() {
+		seed = pe.seed(backends)
+	}
+	if backends[j].cost(seed) < backends[i].cost(seed) {
+		return backends[j]
+	}
+	return backends[i]
+}
@@ -0,0 +1,213 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half_open"
+	CircuitOpen     = "open"
+
+	DefaultCircuitConsecutiveFailures = 5
+	DefaultCircuitWindow              = 10 * time.Second
+	DefaultCircuitMinRequests         = 20
+	DefaultCircuitOpenTimeout         = 30 * time.Second
+	DefaultCircuitHalfOpenMaxRequests = 1
+)
+
+// CircuitBreaker stops the requests to a failing backend. It opens after consecutive failures or when the failure
+// ratio of the window is reached. After the open timeout it lets a few trial requests pass (half open), closing
+// again when all of them succeed or opening on the first failure.
+type CircuitBreaker struct {
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+
+	config              config.CircuitBreaker
+	consecutiveFailures uint32
+	windowStart         time.Time
+	windowRequests      uint32
+	windowFailures      uint32
+	halfOpenRequests    uint32
+	halfOpenSuccesses   uint32
+	onStateChange       func(from string, to string)
+	mux                 sync.Mutex
+}
+
+func NewCircuitBreaker(breakerConfig config.CircuitBreaker, onStateChange func(from string, to string)) *CircuitBreaker {
+	if breakerConfig.ConsecutiveFailures == 0 {
+		breakerConfig.ConsecutiveFailures = DefaultCircuitConsecutiveFailures
+	}
+	if breakerConfig.Window <= 0 {
+		breakerConfig.Window = DefaultCircuitWindow
+	}
+	if breakerConfig.MinRequests == 0 {
+		breakerConfig.MinRequests = DefaultCircuitMinRequests
+	}
+	if breakerConfig.OpenTimeout <= 0 {
+		breakerConfig.OpenTimeout = DefaultCircuitOpenTimeout
+	}
+	if breakerConfig.HalfOpenMaxRequests == 0 {
+		breakerConfig.HalfOpenMaxRequests = DefaultCircuitHalfOpenMaxRequests
+	}
+	now := time.Now()
+	return &CircuitBreaker{State: CircuitClosed, Since: now, config: breakerConfig, windowStart: now, onStateChange: onStateChange}
+}
+
+// Ready returns true when the breaker lets requests pass
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return cb.ready(time.Now())
+}
+
+// Allow returns true when the breaker lets the request pass, taking one of the trials when half open
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if !cb.ready(time.Now()) {
+		return false
+	}
+	if cb.State == CircuitHalfOpen {
+		cb.halfOpenRequests++
+	}
+	return true
+}
+
+func (cb *CircuitBreaker) ready(now time.Time) bool {
+	if !cb.config.Enabled {
+		return true
+	}
+	switch cb.State {
+	case CircuitOpen:
+		if now.Sub(cb.Since) < cb.config.OpenTimeout {
+			return false
+		}
+		cb.setState(CircuitHalfOpen, "open timeout elapsed", now)
+		return true
+	case CircuitHalfOpen:
+		// Trials that never finished don't hold the breaker half open forever
+		if now.Sub(cb.Since) >= cb.config.OpenTimeout {
+			cb.setState(CircuitHalfOpen, "trial requests timed out", now)
+		}
+		return cb.halfOpenRequests < cb.config.HalfOpenMaxRequests
+	default:
+		return true
+	}
+}
+
+// OnResult records the result of a request that passed the breaker
+func (cb *CircuitBreaker) OnResult(failure bool) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if !cb.config.Enabled {
+		return
+	}
+
+	now := time.Now()
+	switch cb.State {
+	case CircuitHalfOpen:
+		if failure {
+			cb.setState(CircuitOpen, "trial request failed", now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.config.HalfOpenMaxRequests {
+			cb.setState(CircuitClosed, "trial requests succeeded", now)
+		}
+	case CircuitClosed:
+		if now.Sub(cb.windowStart) >= cb.config.Window {
+			cb.windowStart = now
+			cb.windowRequests = 0
+			cb.windowFailures = 0
+		}
+		cb.windowRequests++
+		if !failure {
+			cb.consecutiveFailures = 0
+			return
+		}
+		cb.consecutiveFailures++
+		cb.windowFailures++
+
+		if cb.consecutiveFailures >= cb.config.ConsecutiveFailures {
+			cb.setState(CircuitOpen, fmt.Sprintf("%d consecutive failures", cb.consecutiveFailures), now)
+			return
+		}
+		ratio := float64(cb.windowFailures) / float64(cb.windowRequests)
+		if cb.config.FailureRatio > 0 && cb.windowRequests >= cb.config.MinRequests && ratio >= cb.config.FailureRatio {
+			cb.setState(CircuitOpen, fmt.Sprintf("failure ratio %.2f in %s", ratio, cb.config.Window), now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) setState(state string, reason string, now time.Time) {
+	from := cb.State
+	cb.State = state
+	cb.Since = now
+	cb.Reason = reason
+	cb.consecutiveFailures = 0
+	cb.windowStart = now
+	cb.windowRequests = 0
+	cb.windowFailures = 0
+	cb.halfOpenRequests = 0
+	cb.halfOpenSuccesses = 0
+	if cb.onStateChange != nil && from != state {
+		cb.onStateChange(from, state)
+	}
+}
+
+// restore takes the state persisted by this or another router when it's newer, returning true when it changed
+func (cb *CircuitBreaker) restore(state circuitBreakerState) bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if !state.Since.After(cb.Since) || stateValue(state.State) < 0 {
+		return false
+	}
+	changed := state.State != cb.State
+	cb.State = state.State
+	cb.Since = state.Since
+	cb.Reason = state.Reason
+	cb.consecutiveFailures = 0
+	cb.windowStart = time.Now()
+	cb.windowRequests = 0
+	cb.windowFailures = 0
+	cb.halfOpenRequests = 0
+	cb.halfOpenSuccesses = 0
+	return changed
+}
+
+// MarshalJSON persists the state of the breaker with the backend state
+func (cb *CircuitBreaker) MarshalJSON() ([]byte, error) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return json.Marshal(circuitBreakerState{State: cb.State, Since: cb.Since, Reason: cb.Reason})
+}
+
+type circuitBreakerState struct {
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// stateValue returns the state as metric value, -1 when it's unknown
+func stateValue(state string) float64 {
+	switch state {
+	case CircuitClosed:
+		return 0
+	case CircuitHalfOpen:
+		return 1
+	case CircuitOpen:
+		return 2
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,435 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+	"github.com/ortisan/router-go/internal/telemetry"
+)
+
+const (
+	ProtocolAuto  = "auto"
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 10
+	DefaultKeepAlive           = 30 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// roundTripper is the transport of the pool, HTTP/1.1 or HTTP/2
+type roundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// ConnectionPool holds the upstream connections of a server pool and keeps their statistics
+type ConnectionPool struct {
+	prefix          string
+	transport       roundTripper
+	upgrade         roundTripper
+	stream          roundTripper
+	grpc            roundTripper
+	maxConnLifetime time.Duration
+	conns           map[string]*trackedConn
+	open            int
+	inUse           int
+	mux             sync.Mutex
+}
+
+func NewConnectionPool(prefix string, transportConfig config.Transport, timeouts Timeouts) (*ConnectionPool, error) {
+	tlsConfig, err := newTLSConfig(transportConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	maxIdleConns := transportConfig.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = DefaultMaxIdleConns
+	}
+	maxIdleConnsPerHost := transportConfig.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	keepAlive := transportConfig.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	cp := &ConnectionPool{prefix: prefix, maxConnLifetime: transportConfig.MaxConnLifetime, conns: make(map[string]*trackedConn)}
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: keepAlive}
+	t1 := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return cp.dial(ctx, dialer, network, address)
+		},
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       transportConfig.MaxConnsPerHost,
+		IdleConnTimeout:       timeouts.Idle,
+		TLSHandshakeTimeout:   timeouts.Connect,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	// Upgraded connections (WebSocket) are only possible with HTTP/1.1
+	upgrade := t1.Clone()
+	upgrade.ForceAttemptHTTP2 = false
+	upgrade.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+
+	// The HTTP/2 transport has no response header timeout, so the tracked transport applies it
+	var transport roundTripper
+	var responseHeaderTimeout time.Duration
+	switch transportConfig.Protocol {
+	case "", ProtocolAuto:
+		// HTTP/2 when the TLS handshake negotiates it, HTTP/1.1 otherwise
+		transport = t1
+	case ProtocolHTTP1:
+		transport = upgrade
+	case ProtocolH2:
+		if _, err := http2.ConfigureTransports(t1); err != nil {
+			return nil, errApp.NewGenericError("Error to configure http2 transport", err)
+		}
+		transport = t1
+	case ProtocolH2C:
+		// HTTP/2 with prior knowledge over plain text connections
+		transport = &http2.Transport{
+			AllowHTTP:       true,
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network string, address string, _ *tls.Config) (net.Conn, error) {
+				return cp.dial(context.Background(), dialer, network, address)
+			},
+			ReadIdleTimeout: timeouts.Idle,
+		}
+		responseHeaderTimeout = timeouts.ResponseHeader
+	default:
+		return nil, errApp.NewGenericError(fmt.Sprintf("Unknown upstream protocol \"%s\"", transportConfig.Protocol), nil)
+	}
+
+	// Streams (long-poll) wait the response headers as long as their idle timeout
+	stream := transport
+	if t, ok := transport.(*http.Transport); ok {
+		streamTransport := t.Clone()
+		streamTransport.ResponseHeaderTimeout = 0
+		stream = streamTransport
+	}
+
+	// gRPC calls always need HTTP/2, even when the REST calls of the pool are HTTP/1.1. They have the deadline
+	// of the client instead of the response header timeout.
+	grpc := stream
+	if transportConfig.Protocol != ProtocolH2 && transportConfig.Protocol != ProtocolH2C {
+		h2 := t1.Clone()
+		h2.ResponseHeaderTimeout = 0
+		if _, err := http2.ConfigureTransports(h2); err != nil {
+			return nil, errApp.NewGenericError("Error to configure http2 transport", err)
+		}
+		grpc = &grpcTransport{
+			h2: h2,
+			h2c: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network string, address string, _ *tls.Config) (net.Conn, error) {
+					return cp.dial(context.Background(), dialer, network, address)
+				},
+				ReadIdleTimeout: timeouts.Idle,
+			},
+		}
+	}
+
+	cp.transport = &trackedTransport{roundTripper: transport, pool: cp, responseHeaderTimeout: responseHeaderTimeout}
+	cp.stream = &trackedTransport{roundTripper: stream, pool: cp}
+	cp.upgrade = &trackedTransport{roundTripper: upgrade, pool: cp}
+	cp.grpc = &trackedTransport{roundTripper: grpc, pool: cp}
+	return cp, nil
+}
+
+// Client returns a client that shares the connections of the pool
+func (cp *ConnectionPool) Client() *http.Client {
+	return &http.Client{Transport: cp.transport}
+}
+
+// StreamClient returns a client without response header timeout for the streaming paths
+func (cp *ConnectionPool) StreamClient() *http.Client {
+	return &http.Client{Transport: cp.stream}
+}
+
+// UpgradeClient returns a HTTP/1.1 client for the upgrade requests
+func (cp *ConnectionPool) UpgradeClient() *http.Client {
+	return &http.Client{Transport: cp.upgrade}
+}
+
+// GrpcClient returns a HTTP/2 client for the gRPC calls: h2c for http backends and h2 for https ones
+func (cp *ConnectionPool) GrpcClient() *http.Client {
+	return &http.Client{Transport: cp.grpc}
+}
+
+// Stats returns the open and in use connections
+func (cp *ConnectionPool) Stats() (open int, inUse int) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	return cp.open, cp.inUse
+}
+
+// recycleConnections closes the idle connections older than the max connection lifetime. The busy ones are closed
+// when their last response ends.
+func (cp *ConnectionPool) recycleConnections() {
+	t := time.NewTicker(cp.maxConnLifetime)
+	for range t.C {
+		cp.closeExpiredConnections()
+	}
+}
+
+func (cp *ConnectionPool) closeExpiredConnections() {
+	var expired []*trackedConn
+	cp.mux.Lock()
+	for _, conn := range cp.conns {
+		if conn.streams == 0 && cp.expired(conn) {
+			expired = append(expired, conn)
+		}
+	}
+	cp.mux.Unlock()
+	for _, conn := range expired {
+		conn.Close()
+	}
+}
+
+func (cp *ConnectionPool) closeIdleConnections() {
+	cp.transport.CloseIdleConnections()
+	cp.upgrade.CloseIdleConnections()
+	cp.stream.CloseIdleConnections()
+	cp.grpc.CloseIdleConnections()
+}
+
+func (cp *ConnectionPool) expired(conn *trackedConn) bool {
+	return cp.maxConnLifetime > 0 && time.Since(conn.dialed) >= cp.maxConnLifetime
+}
+
+func (cp *ConnectionPool) dial(ctx context.Context, dialer *net.Dialer, network string, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		telemetry.UpstreamDialErrors.WithLabelValues(cp.prefix).Inc()
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, pool: cp, dialed: time.Now()}
+	cp.mux.Lock()
+	cp.conns[connKey(conn)] = tc
+	cp.open++
+	cp.updateMetrics()
+	cp.mux.Unlock()
+	return tc, nil
+}
+
+// acquire counts the request on the connection, which is in use while it has requests (HTTP/2 multiplexes them)
+func (cp *ConnectionPool) acquire(netConn net.Conn) *trackedConn {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	// TLS connections wrap the tracked connection, so it's found by the addresses
+	conn := cp.conns[connKey(netConn)]
+	if conn == nil {
+		return nil
+	}
+	conn.streams++
+	if conn.streams == 1 {
+		cp.inUse++
+		cp.updateMetrics()
+	}
+	return conn
+}
+
+// release ends the request on the connection, closing it when it's idle and older than the max lifetime
+func (cp *ConnectionPool) release(conn *trackedConn) {
+	cp.mux.Lock()
+	if conn.closed || conn.streams == 0 {
+		cp.mux.Unlock()
+		return
+	}
+	conn.streams--
+	idle := conn.streams == 0
+	if idle {
+		cp.inUse--
+		cp.updateMetrics()
+	}
+	cp.mux.Unlock()
+	if idle && cp.expired(conn) {
+		conn.Close()
+	}
+}
+
+func (cp *ConnectionPool) onClose(conn *trackedConn) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	delete(cp.conns, connKey(conn))
+	cp.open--
+	if conn.streams > 0 {
+		cp.inUse--
+	}
+	cp.updateMetrics()
+}
+
+func (cp *ConnectionPool) updateMetrics() {
+	telemetry.UpstreamConnections.WithLabelValues(cp.prefix, "open").Set(float64(cp.open))
+	telemetry.UpstreamConnections.WithLabelValues(cp.prefix, "in_use").Set(float64(cp.inUse))
+	telemetry.UpstreamConnections.WithLabelValues(cp.prefix, "idle").Set(float64(cp.open - cp.inUse))
+}
+
+func connKey(conn net.Conn) string {
+	return conn.LocalAddr().String() + "-" + conn.RemoteAddr().String()
+}
+
+// trackedConn is an upstream connection counted by the connection pool
+type trackedConn struct {
+	net.Conn
+	pool    *ConnectionPool
+	dialed  time.Time
+	streams int
+	closed  bool
+}
+
+func (c *trackedConn) Close() error {
+	c.pool.onClose(c)
+	return c.Conn.Close()
+}
+
+// grpcTransport sends the gRPC calls with HTTP/2 by the scheme of the backend
+type grpcTransport struct {
+	h2  *http.Transport
+	h2c *http2.Transport
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.h2.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+func (t *grpcTransport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// trackedTransport counts the connection of each request as in use until the response body is closed
+type trackedTransport struct {
+	roundTripper
+	pool                  *ConnectionPool
+	responseHeaderTimeout time.Duration
+}
+
+func (t *trackedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *trackedConn
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = t.pool.acquire(info.Conn)
+		},
+	})
+
+	// The request is canceled when the response headers don't arrive in time
+	cancel := func() {}
+	var timer *time.Timer
+	var timedOut int32
+	if t.responseHeaderTimeout > 0 {
+		var cancelCtx context.CancelFunc
+		ctx, cancelCtx = context.WithCancel(ctx)
+		timer = time.AfterFunc(t.responseHeaderTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancelCtx()
+		})
+		cancel = cancelCtx
+	}
+
+	resp, err := t.roundTripper.RoundTrip(req.WithContext(ctx))
+	if timer != nil {
+		timer.Stop()
+	}
+	release := func() {
+		cancel()
+		if conn != nil {
+			t.pool.release(conn)
+		}
+	}
+	if err != nil {
+		release()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The tunnel holds the connection until it's closed
+		return resp, nil
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// trackedBody releases the connection of the response when it's closed
+type trackedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func newTLSConfig(tlsConfig config.TLS) (*tls.Config, error) {
+	result := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	if tlsConfig.MinVersion != "" {
+		version, ok := tlsVersions[tlsConfig.MinVersion]
+		if !ok {
+			return nil, errApp.NewGenericError(fmt.Sprintf("Unknown tls version \"%s\"", tlsConfig.MinVersion), nil)
+		}
+		result.MinVersion = version
+	}
+	if tlsConfig.CAFile != "" {
+		ca, err := ioutil.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, errApp.NewGenericError("Error to read the tls ca file", err)
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errApp.NewGenericError(fmt.Sprintf("No certificates found into \"%s\"", tlsConfig.CAFile), nil)
+		}
+	}
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, errApp.NewGenericError("Error to load the tls client certificate", err)
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
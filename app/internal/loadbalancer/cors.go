@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+)
+
+var DefaultCorsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// CorsPolicy answers the preflights of the browsers and adds the CORS headers to the responses of a pool
+type CorsPolicy struct {
+	origins       []string
+	methods       map[string]bool
+	allowMethods  string
+	headers       map[string]bool
+	anyHeader     bool
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	maxAge        string
+}
+
+func NewCorsPolicy(corsConfig config.CORS) (*CorsPolicy, error) {
+	p := &CorsPolicy{
+		methods:       make(map[string]bool),
+		headers:       make(map[string]bool),
+		exposeHeaders: strings.Join(corsConfig.ExposedHeaders, ", "),
+		credentials:   corsConfig.AllowCredentials,
+	}
+	for _, origin := range corsConfig.AllowedOrigins {
+		// Any site could do credentialed calls
+		if origin == "*" && corsConfig.AllowCredentials {
+			return nil, errApp.NewGenericError("CORS can't allow all origins (*) with credentials", nil)
+		}
+		p.origins = append(p.origins, strings.ToLower(origin))
+	}
+	allowedMethods := corsConfig.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = DefaultCorsMethods
+	}
+	var methods []string
+	for _, method := range allowedMethods {
+		method = strings.ToUpper(method)
+		p.methods[method] = true
+		methods = append(methods, method)
+	}
+	p.allowMethods = strings.Join(methods, ", ")
+	for _, header := range corsConfig.AllowedHeaders {
+		if header == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	p.allowHeaders = strings.Join(corsConfig.AllowedHeaders, ", ")
+	if corsConfig.MaxAge > 0 {
+		p.maxAge = strconv.FormatInt(int64(corsConfig.MaxAge.Seconds()), 10)
+	}
+	return p, nil
+}
+
+// matchWildcard matches the value with the allowed one, which can have a wildcard (https://*.example.com)
+func matchWildcard(allowed string, value string) bool {
+	if allowed == "*" {
+		return true
+	}
+	i := strings.Index(allowed, "*")
+	if i < 0 {
+		return allowed == value
+	}
+	prefix, suffix := allowed[:i], allowed[i+1:]
+	return len(value) > len(prefix)+len(suffix) && strings.HasPrefix(value, prefix) && strings.HasSuffix(value, suffix)
+}
+
+// AllowedOrigin returns true when the origin can call the pool
+func (p *CorsPolicy) AllowedOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if matchWildcard(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin, * only when all origins are allowed without credentials
+func (p *CorsPolicy) allowOrigin(origin string) string {
+	if !p.credentials {
+		for _, allowed := range p.origins {
+			if allowed == "*" {
+				return "*"
+			}
+		}
+	}
+	return origin
+}
+
+// IsPreflight returns true when the request is a CORS preflight
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// HandlePreflight answers the preflight without calling the backends, without CORS headers when it isn't allowed
+func (p *CorsPolicy) HandlePreflight(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	if p.AllowedOrigin(origin) && p.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+		requestHeaders, allowed := p.requestHeaders(r.Header.Get("Access-Control-Request-Headers"))
+		if allowed {
+			header.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+			header.Set("Access-Control-Allow-Methods", p.allowMethods)
+			if p.anyHeader && requestHeaders != "" {
+				header.Set("Access-Control-Allow-Headers", requestHeaders)
+			} else if p.allowHeaders != "" {
+				header.Set("Access-Control-Allow-Headers", p.allowHeaders)
+			}
+			if p.credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if p.maxAge != "" {
+				header.Set("Access-Control-Max-Age", p.maxAge)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestHeaders returns the headers requested by the preflight and if all of them are allowed
+func (p *CorsPolicy) requestHeaders(value string) (string, bool) {
+	var requested []string
+	for _, header := range strings.Split(value, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !p.anyHeader && !p.headers[http.CanonicalHeaderKey(header)] {
+			return "", false
+		}
+		requested = append(requested, header)
+	}
+	return strings.Join(requested, ", "), true
+}
+
+// SetHeaders adds the CORS headers to the response of an allowed origin
+func (p *CorsPolicy) SetHeaders(header http.Header, r *http.Request) {
+	header.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !p.AllowedOrigin(origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.exposeHeaders != "" {
+		header.Set("Access-Control-Expose-Headers", p.exposeHeaders)
+	}
+}
+
+// removeCorsHeaders removes the CORS headers of the backend, so the policy of the router prevails
+func removeCorsHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEwmaDecay      = 10 * time.Second
+	DefaultEwmaInitialRtt = 100 * time.Millisecond
+)
+
+// PeakEwma holds the moving average of the response times of a backend. Peaks are taken
+// right away and decay over time, so a degraded backend gets a high cost quickly.
+type PeakEwma struct {
+	decay time.Duration
+	value float64
+	stamp time.Time
+	mux   sync.Mutex
+}
+
+func NewPeakEwma(decay time.Duration) *PeakEwma {
+	if decay <= 0 {
+		decay = DefaultEwmaDecay
+	}
+	return &PeakEwma{decay: decay}
+}
+
+// Observe adds a response time into the average
+func (e *PeakEwma) Observe(rtt time.Duration) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	now := time.Now()
+	value := float64(rtt)
+	if e.stamp.IsZero() || value > e.value {
+		e.value = value
+	} else {
+		w := e.weight(now)
+		e.value = e.value*w + value*(1-w)
+	}
+	e.stamp = now
+}
+
+// Value returns the average decayed until now, so backends without traffic are tried again
+func (e *PeakEwma) Value() float64 {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.stamp.IsZero() {
+		return 0
+	}
+	return e.value * e.weight(time.Now())
+}
+
+// Sampled returns true when the average has response times
+func (e *PeakEwma) Sampled() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return !e.stamp.IsZero()
+}
+
+// Reset drops the response times, like for a backend that was down
+func (e *PeakEwma) Reset() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.value = 0
+	e.stamp = time.Time{}
+}
+
+func (e *PeakEwma) weight(now time.Time) float64 {
+	elapsed := now.Sub(e.stamp)
+	return math.Exp(-float64(elapsed) / float64(e.decay))
+}
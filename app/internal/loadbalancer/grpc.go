@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+	"github.com/ortisan/router-go/internal/telemetry"
+)
+
+// gRPC status codes handled by the router
+const (
+	GrpcStatusOK               = 0
+	GrpcStatusUnknown          = 2
+	GrpcStatusDeadlineExceeded = 4
+	GrpcStatusUnimplemented    = 12
+	GrpcStatusUnavailable      = 14
+
+	GrpcStatusHeaderName  = "Grpc-Status"
+	GrpcMessageHeaderName = "Grpc-Message"
+	GrpcTimeoutHeaderName = "Grpc-Timeout"
+)
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// IsGrpc returns true when the header is of a gRPC request or response
+func IsGrpc(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// GrpcServiceName returns the service of a gRPC path (/package.Service/Method)
+func GrpcServiceName(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || !strings.Contains(parts[0], ".") {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// GrpcServicePrefix returns the service prefix of the pool that handles the gRPC service. The services are matched
+// by the full name or by the package (package.*).
+func GrpcServicePrefix(grpcServices []config.GrpcService, serviceName string) (string, bool) {
+	for _, grpcService := range grpcServices {
+		if grpcService.Service == serviceName {
+			return grpcService.ServicePrefix, true
+		}
+	}
+	for _, grpcService := range grpcServices {
+		if pkg := strings.TrimSuffix(grpcService.Service, "*"); pkg != grpcService.Service && strings.HasPrefix(serviceName, pkg) {
+			return grpcService.ServicePrefix, true
+		}
+	}
+	return "", false
+}
+
+// grpcStatus returns the gRPC status of a header or trailer
+func grpcStatus(header http.Header) (int, bool) {
+	value := header.Get(GrpcStatusHeaderName)
+	if value == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return GrpcStatusUnknown, true
+	}
+	return code, true
+}
+
+// grpcResultStatus returns the HTTP status equivalent to the gRPC status for the outlier detection and the circuit
+// breaker, which only see UNAVAILABLE and DEADLINE_EXCEEDED as failures
+func grpcResultStatus(code int) int {
+	switch code {
+	case GrpcStatusUnavailable:
+		return http.StatusServiceUnavailable
+	case GrpcStatusDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusOK
+	}
+}
+
+// onGrpcResult records the gRPC status of a call to the backend
+func (s *ServerPool) onGrpcResult(b *Backend, code int) {
+	telemetry.GrpcResponses.WithLabelValues(s.ServicePrefix, strconv.Itoa(code)).Inc()
+	s.onResult(b, grpcResultStatus(code), nil)
+}
+
+// parseGrpcTimeout parses the timeout of a gRPC call, like 100m or 5S
+func parseGrpcTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// formatGrpcTimeout formats the timeout of a gRPC call in milliseconds
+func formatGrpcTimeout(timeout time.Duration) string {
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return fmt.Sprintf("%dm", ms)
+}
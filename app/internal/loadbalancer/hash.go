@@ -0,0 +1,147 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+)
+
+const (
+	HashKeyTypeHeader   = "header"
+	HashKeyTypeCookie   = "cookie"
+	HashKeyTypeQuery    = "query"
+	HashKeyTypeIP       = "ip"
+	DefaultVirtualNodes = 160
+)
+
+// ConsistentHashBalancer places all the backends of the pool into a hash ring with virtual nodes and takes
+// the first backend of the candidates that follows the hash of the request key. When a backend leaves or joins
+// the healthy ones, only the keys of that backend are remapped.
+type ConsistentHashBalancer struct {
+	key          config.HashKey
+	virtualNodes int
+	members      map[*Backend]bool
+	hashes       []uint32
+	ring         map[uint32]*Backend
+	mux          sync.RWMutex
+}
+
+func NewConsistentHashBalancer(service config.Service) (*ConsistentHashBalancer, error) {
+	key := service.HashKey
+	switch key.Type {
+	case "":
+		key.Type = HashKeyTypeIP
+	case HashKeyTypeIP:
+	case HashKeyTypeHeader, HashKeyTypeCookie, HashKeyTypeQuery:
+		if key.Name == "" {
+			return nil, errApp.NewGenericError(fmt.Sprintf("Hash key of type \"%s\" without name for the prefix \"%s\"", key.Type, service.ServicePrefix), nil)
+		}
+	default:
+		return nil, errApp.NewGenericError(fmt.Sprintf("Unknown hash key type \"%s\" for the prefix \"%s\"", key.Type, service.ServicePrefix), nil)
+	}
+
+	virtualNodes := service.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &ConsistentHashBalancer{key: key, virtualNodes: virtualNodes, members: make(map[*Backend]bool), ring: make(map[uint32]*Backend)}, nil
+}
+
+func (ch *ConsistentHashBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	ch.add(backends...)
+
+	ch.mux.RLock()
+	defer ch.mux.RUnlock()
+
+	// Walks the ring clockwise until a candidate
+	hash := crc32.ChecksumIEEE([]byte(ch.hashKey(r)))
+	idx := sort.Search(len(ch.hashes), func(i int) bool { return ch.hashes[i] >= hash })
+	for i := 0; i < len(ch.hashes); i++ {
+		b := ch.ring[ch.hashes[(idx+i)%len(ch.hashes)]]
+		if containsBackend(backends, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// add places the virtual nodes of the backends that aren't into the ring yet
+func (ch *ConsistentHashBalancer) add(backends ...*Backend) {
+	ch.mux.RLock()
+	missing := false
+	for _, b := range backends {
+		if !ch.members[b] {
+			missing = true
+			break
+		}
+	}
+	ch.mux.RUnlock()
+	if !missing {
+		return
+	}
+
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+	added := false
+	for _, b := range backends {
+		if ch.members[b] {
+			continue
+		}
+		ch.members[b] = true
+		added = true
+		for i := 0; i < ch.virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(b.URL.Host + "-" + strconv.Itoa(i)))
+			if _, found := ch.ring[hash]; found {
+				continue
+			}
+			ch.ring[hash] = b
+			ch.hashes = append(ch.hashes, hash)
+		}
+	}
+	if added {
+		sort.Slice(ch.hashes, func(i, j int) bool { return ch.hashes[i] < ch.hashes[j] })
+	}
+}
+
+// hashKey returns the value of the request used to choose the backend, falling back to the client ip
+func (ch *ConsistentHashBalancer) hashKey(r *http.Request) string {
+	var value string
+	switch ch.key.Type {
+	case HashKeyTypeHeader:
+		value = r.Header.Get(ch.key.Name)
+	case HashKeyTypeCookie:
+		if cookie, err := r.Cookie(ch.key.Name); err == nil {
+			value = cookie.Value
+		}
+	case HashKeyTypeQuery:
+		value = r.URL.Query().Get(ch.key.Name)
+	}
+	if value != "" {
+		return value
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func containsBackend(backends []*Backend, b *Backend) bool {
+	for _, candidate := range backends {
+		if candidate == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultHeadersDisabledInRedirection are the client headers that aren't sent to the backends by default
+var DefaultHeadersDisabledInRedirection = []string{
+	"Accept-Encoding", // This header transform encodings
+}
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, which are meaningful only for a single connection
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HeadersDisabledInRedirection returns the matcher of the headers that aren't sent to the backends
+func HeadersDisabledInRedirection(headers []string) func(string) bool {
+	if headers == nil {
+		headers = DefaultHeadersDisabledInRedirection
+	}
+	innerMap := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		innerMap[textproto.CanonicalMIMEHeaderKey(header)] = true
+	}
+	return func(key string) bool {
+		return innerMap[textproto.CanonicalMIMEHeaderKey(key)]
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones listed into the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		// "TE: trailers" tells the backend that the client accepts trailers, as gRPC requires
+		if name == "Te" && header.Get(name) == "trailers" {
+			continue
+		}
+		header.Del(name)
+	}
+}
+
+// addForwardedHeaders tells the backend about the client and the router that forwarded the request
+func addForwardedHeaders(header http.Header, clientReq *http.Request, via string) {
+	proto := "http"
+	if clientReq.TLS != nil {
+		proto = "https"
+	}
+
+	clientIP, _, err := net.SplitHostPort(clientReq.RemoteAddr)
+	if err != nil {
+		clientIP = clientReq.RemoteAddr
+	}
+	if clientIP != "" {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", clientReq.Host)
+
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(clientIP), quoteForwarded(clientReq.Host), proto)
+	header.Add("Forwarded", forwarded)
+
+	addVia(header, clientReq.ProtoMajor, clientReq.ProtoMinor, via)
+}
+
+// addVia adds the router to the Via header of a request or response
+func addVia(header http.Header, protoMajor int, protoMinor int, via string) {
+	header.Add("Via", fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, via))
+}
+
+// forwardedNode formats the address of the client as a node of the Forwarded header (RFC 7239)
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return ip
+}
+
+// quoteForwarded quotes the values of the Forwarded header that aren't tokens
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\",;= ") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+	"github.com/ortisan/router-go/internal/telemetry"
+)
+
+const (
+	DefaultHedgeDelay              = 100 * time.Millisecond
+	DefaultHedgeBudgetPercent      = 10
+	LatencyWindowSize              = 1000
+	LatencyWindowMinSamples        = 20
+	DefaultHedgeMinHedgesPerSecond = 1
+)
+
+// LatencyWindow holds the last response times of a pool
+type LatencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+	mux     sync.Mutex
+}
+
+func NewLatencyWindow(size int) *LatencyWindow {
+	return &LatencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (lw *LatencyWindow) Observe(latency time.Duration) {
+	lw.mux.Lock()
+	lw.samples[lw.next] = latency
+	lw.next = (lw.next + 1) % len(lw.samples)
+	if lw.next == 0 {
+		lw.full = true
+	}
+	lw.mux.Unlock()
+}
+
+// Percentile returns the percentile of the response times, or false while there aren't enough samples
+func (lw *LatencyWindow) Percentile(percentile float64) (time.Duration, bool) {
+	lw.mux.Lock()
+	count := lw.next
+	if lw.full {
+		count = len(lw.samples)
+	}
+	sorted := append([]time.Duration{}, lw.samples[:count]...)
+	lw.mux.Unlock()
+
+	if count < LatencyWindowMinSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(percentile / 100 * float64(count-1))
+	return sorted[idx], true
+}
+
+// HedgingPolicy sends a copy of idempotent reads to another backend when the first one doesn't answer
+// within the hedge delay. The delay is fixed or a percentile of the response times of the pool.
+type HedgingPolicy struct {
+	delay      time.Duration
+	percentile float64
+	latencies  *LatencyWindow
+	budget     *RetryBudget
+}
+
+func NewHedgingPolicy(hedgingConfig config.Hedging) (*HedgingPolicy, error) {
+	// Without percentile (0), the delay is fixed
+	if hedgingConfig.DelayPercentile < 0 || hedgingConfig.DelayPercentile > 100 {
+		return nil, errApp.NewGenericError(fmt.Sprintf("Hedge delay percentile %v must be greater than 0 and up to 100", hedgingConfig.DelayPercentile), nil)
+	}
+	delay := hedgingConfig.Delay
+	if delay <= 0 {
+		delay = DefaultHedgeDelay
+	}
+	budgetPercent := hedgingConfig.BudgetPercent
+	if budgetPercent <= 0 {
+		budgetPercent = DefaultHedgeBudgetPercent
+	}
+	minHedgesPerSecond := hedgingConfig.MinHedgesPerSecond
+	if minHedgesPerSecond <= 0 {
+		minHedgesPerSecond = DefaultHedgeMinHedgesPerSecond
+	}
+	return &HedgingPolicy{
+		delay:      delay,
+		percentile: hedgingConfig.DelayPercentile,
+		latencies:  NewLatencyWindow(LatencyWindowSize),
+		budget:     NewRetryBudget(config.RetryBudget{Percent: budgetPercent, MinRetriesPerSecond: minHedgesPerSecond}),
+	}, nil
+}
+
+// Applies returns true for the reads without body
+func (h *HedgingPolicy) Applies(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && (r.Body == nil || r.Body == http.NoBody)
+}
+
+// Delay returns the time to wait the first backend before hedging
+func (h *HedgingPolicy) Delay() time.Duration {
+	if h.percentile > 0 {
+		if delay, ok := h.latencies.Percentile(h.percentile); ok {
+			return delay
+		}
+	}
+	return h.delay
+}
+
+// hedge sends the request to the backend and, after the hedge delay, a copy to another healthy backend.
+// The first response wins and the other request is canceled.
+func (s *ServerPool) hedge(ctx context.Context, pr *proxyRequest, peer *Backend, tried []*Backend, attempt int) *attemptResult {
+	s.hedging.budget.OnRequest()
+	results := make(chan *attemptResult, 2)
+	cancels := make(map[*Backend]context.CancelFunc, 2)
+	launch := func(b *Backend, hedge bool) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[b] = cancel
+		go func() {
+			results <- s.send(attemptCtx, cancel, pr, b, attempt, hedge)
+		}()
+	}
+	launch(peer, false)
+
+	timer := time.NewTimer(s.hedging.Delay())
+	defer timer.Stop()
+
+	var hedgePeer *Backend
+	var failed *attemptResult
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			next := s.GetNextBackend(pr.c.Request, append(tried, peer)...)
+			if next != nil && s.allowHedge() {
+				hedgePeer = next
+				pending++
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("hedged", true))
+				launch(next, true)
+			}
+		case result := <-results:
+			pending--
+			// A failure waits the other request, if there is one
+			if result.err != nil && pending > 0 {
+				failed = result
+				continue
+			}
+			if failed != nil {
+				failed.close()
+			}
+			if pending > 0 {
+				for b, cancel := range cancels {
+					if b != result.peer {
+						cancel()
+					}
+				}
+				go func() {
+					(<-results).close()
+				}()
+			}
+			result.hedge = hedgePeer
+			return result
+		}
+	}
+}
+
+// allowHedge takes a hedge from the hedging budget of the pool
+func (s *ServerPool) allowHedge() bool {
+	if !s.hedging.budget.TryRetry() {
+		log.Debug().Str("prefix", s.ServicePrefix).Msg("Hedging budget exhausted.")
+		telemetry.HedgeBudgetExhausted.WithLabelValues(s.ServicePrefix).Inc()
+		return false
+	}
+	telemetry.Hedges.WithLabelValues(s.ServicePrefix).Inc()
+	return true
+}
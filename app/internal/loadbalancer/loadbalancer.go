@@ -3,9 +3,12 @@ package loadbalancer
 // Forked by https://github.com/kasvith/simplelb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -24,6 +27,7 @@ import (
 	"github.com/ortisan/router-go/internal/constant"
 	errApp "github.com/ortisan/router-go/internal/error"
 	"github.com/ortisan/router-go/internal/repository"
+	"github.com/ortisan/router-go/internal/telemetry"
 	"github.com/ortisan/router-go/internal/util"
 )
 
@@ -41,6 +45,13 @@ const (
 	HealthCheckTypeTCP   = "tcp"
 	HealthCheckTypeHTTP  = "http"
 	BucketHealthCells    = "health-cells"
+	DefaultWeight        = 1
+)
+
+// Storage of the backend states shared by the routers (health cells bucket), replaced by the tests
+var (
+	getHealthCell = repository.GetStringObject
+	putHealthCell = repository.PutStringObject
 )
 
 type HealthCheck struct {
@@ -57,36 +68,44 @@ type Counts struct {
 	mux                  sync.RWMutex `json:"-"`
 }
 
-func (c *Counts) onRequest() {
+// MarshalJSON persists the counts, holding their lock
+func (c *Counts) MarshalJSON() ([]byte, error) {
+	type counts Counts
 	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return json.Marshal((*counts)(c))
+}
+
+func (c *Counts) onRequest() {
+	c.mux.Lock()
 	c.Requests++
-	c.mux.RUnlock()
+	c.mux.Unlock()
 }
 
 func (c *Counts) onSuccess() {
-	c.mux.RLock()
+	c.mux.Lock()
 	c.TotalSuccesses++
 	c.ConsecutiveSuccesses++
 	c.ConsecutiveFailures = 0
-	c.mux.RUnlock()
+	c.mux.Unlock()
 }
 
 func (c *Counts) onFailure() {
-	c.mux.RLock()
+	c.mux.Lock()
 	c.TotalFailures++
 	c.ConsecutiveFailures++
 	c.ConsecutiveSuccesses = 0
-	c.mux.RUnlock()
+	c.mux.Unlock()
 }
 
 func (c *Counts) clear() {
-	c.mux.RLock()
+	c.mux.Lock()
 	c.Requests = 0
 	c.TotalSuccesses = 0
 	c.TotalFailures = 0
 	c.ConsecutiveSuccesses = 0
 	c.ConsecutiveFailures = 0
-	c.mux.RUnlock()
+	c.mux.Unlock()
 }
 
 // Backend holds the data about a server
@@ -94,16 +113,25 @@ type Backend2 struct {
 	ServicePrefix string `json:"ServicePrefix"`
 }
 type Backend struct {
-	ServicePrefix             string        `json:"ServicePrefix"`
-	URL                       *url.URL      `json:"url"`
-	ZoneAws                   string        `json:"zone_aws"`
-	HealthCheck               HealthCheck   `json:"healthcheck"`
-	Alive                     bool          `json:"alive"`
-	CountsRequests            *Counts       `json:"counts_requests"`
-	CountsHealthChecks        *Counts       `json:"counts_healthchecks"`
-	IntervalToReceiveRequests time.Duration `json:"interval_to_receive_requests"`
-	UpdateDate                time.Time     `json:"update_date"`
-	mux                       sync.RWMutex  `json:"-"`
+	ServicePrefix             string          `json:"ServicePrefix"`
+	URL                       *url.URL        `json:"url"`
+	ZoneAws                   string          `json:"zone_aws"`
+	Weight                    int             `json:"weight"`
+	Priority                  int             `json:"priority"`
+	HealthCheck               HealthCheck     `json:"healthcheck"`
+	Alive                     bool            `json:"alive"`
+	CountsRequests            *Counts         `json:"counts_requests"`
+	CountsHealthChecks        *Counts         `json:"counts_healthchecks"`
+	IntervalToReceiveRequests time.Duration   `json:"interval_to_receive_requests"`
+	UpdateDate                time.Time       `json:"update_date"`
+	EjectedUntil              time.Time       `json:"ejected_until"`
+	CircuitBreaker            *CircuitBreaker `json:"-"`
+	activeRequests            int64           `json:"-"`
+	upSince                   time.Time       `json:"-"`
+	wasAlive                  bool            `json:"-"`
+	latency                   *PeakEwma       `json:"-"`
+	mux                       sync.RWMutex    `json:"-"`
+	circuitMux                sync.Mutex      `json:"-"`
 }
 
 func newHealthcheck(typeStr string, endpoint string) HealthCheck {
@@ -114,12 +142,13 @@ func newHealthcheck(typeStr string, endpoint string) HealthCheck {
 	}
 }
 
-// IsAlive returns true when backend is alive
+// IsAlive returns true when backend is alive. Failures of the requests take the backend down
+// by outlier detection and circuit breaker.
 func (b *Backend) IsAlive() bool {
 	b.mux.RLock()
 
 	var alive = true
-	if b.CountsHealthChecks.ConsecutiveFailures >= MaxRetries || b.CountsRequests.ConsecutiveFailures >= MaxRetries {
+	if b.CountsHealthChecks.ConsecutiveFailures >= MaxRetries || time.Now().Before(b.EjectedUntil) || !b.CircuitBreaker.Ready() {
 		alive = false
 	}
 
@@ -127,21 +156,295 @@ func (b *Backend) IsAlive() bool {
 	return alive
 }
 
+// onCircuitStateChange exposes the transitions of the circuit breaker and persists them with the backend state
+func (b *Backend) onCircuitStateChange(from string, to string) {
+	server := b.URL.String()
+	log.Info().Str("prefix", b.ServicePrefix).Str("server", server).Str("from", from).Str("to", to).Msg("Circuit breaker state changed.")
+	telemetry.CircuitBreakerState.WithLabelValues(b.ServicePrefix, server).Set(stateValue(to))
+	telemetry.CircuitBreakerTransitions.WithLabelValues(b.ServicePrefix, server, from, to).Inc()
+	go func() {
+		if err := b.saveCircuitState(); err != nil {
+			log.Err(err).Str("server", server).Msg("Error to save the circuit breaker state")
+		}
+	}()
+}
+
+// IsEjected returns true while the backend is ejected by outlier detection
+func (b *Backend) IsEjected() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Now().Before(b.EjectedUntil)
+}
+
+func (b *Backend) eject(until time.Time) {
+	b.mux.Lock()
+	b.EjectedUntil = until
+	b.mux.Unlock()
+}
+
+// ActiveRequests returns the number of requests in flight to the backend
+func (b *Backend) ActiveRequests() int64 {
+	return atomic.LoadInt64(&b.activeRequests)
+}
+
+// UpSince returns when the backend was added or was alive again
+func (b *Backend) UpSince() time.Time {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.upSince
+}
+
+// observeAlive restarts the up time and the response times of the backend when it flips from down to up
+func (b *Backend) observeAlive(alive bool) {
+	b.mux.Lock()
+	if alive && !b.wasAlive {
+		b.upSince = time.Now()
+		b.latency.Reset()
+	}
+	b.wasAlive = alive
+	b.mux.Unlock()
+}
+
+// cost returns the peak ewma of the response times weighted by the requests in flight. Backends without
+// response times yet take the seed.
+func (b *Backend) cost(seed float64) float64 {
+	latency := seed
+	if b.latency.Sampled() {
+		latency = b.latency.Value()
+	}
+	return latency * float64(b.ActiveRequests()+1)
+}
+
+func (b *Backend) startRequest() {
+	atomic.AddInt64(&b.activeRequests, 1)
+}
+
+func (b *Backend) endRequest() {
+	atomic.AddInt64(&b.activeRequests, -1)
+}
+
+// stateKey returns the key of the backend state into health cells bucket
+func (b *Backend) stateKey() string {
+	return fmt.Sprintf("servers-%s-%s", b.ServicePrefix, b.URL.Host)
+}
+
+// legacyStateKey returns the key of the state written by the routers with one state by prefix
+func (b *Backend) legacyStateKey() string {
+	return fmt.Sprintf("servers-%s", b.ServicePrefix)
+}
+
+// loadState refreshes the health of the backend with the state shared into health cells bucket
+func (b *Backend) loadState() error {
+	state, err := readState(b.stateKey())
+	if err != nil || state == nil {
+		return err
+	}
+	b.applyState(state)
+	return nil
+}
+
+// restoreState loads the shared state when the router starts. Backends without state yet read the legacy state
+// of the prefix, when it's of the same server. The circuit breaker is restored too.
+func (b *Backend) restoreState() error {
+	state, err := readState(b.stateKey())
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		legacy, err := readState(b.legacyStateKey())
+		if err != nil {
+			return err
+		}
+		if legacy != nil && legacy.URL != nil && legacy.URL.Host == b.URL.Host {
+			state = legacy
+		}
+	}
+	if state != nil {
+		b.applyState(state)
+	}
+	return b.loadCircuitState()
+}
+
+func (b *Backend) applyState(state *Backend) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if state.CountsHealthChecks != nil {
+		b.CountsHealthChecks = state.CountsHealthChecks
+	}
+	b.Alive = state.Alive
+	b.UpdateDate = state.UpdateDate
+}
+
+// circuitStateKey returns the key of the circuit breaker state into health cells bucket
+func (b *Backend) circuitStateKey() string {
+	return b.stateKey() + "-circuit-breaker"
+}
+
+// loadCircuitState restores the circuit breaker state shared into health cells bucket, when it's newer. It's loaded
+// on the health check ticks, out of the path of the requests.
+func (b *Backend) loadCircuitState() error {
+	if !b.CircuitBreaker.config.Enabled {
+		return nil
+	}
+	jsonState, err := getHealthCell(BucketHealthCells, b.circuitStateKey())
+	if err != nil {
+		switch err.(type) {
+		case errApp.NotFoundError: // Never changed
+			return nil
+		default:
+			return err
+		}
+	}
+	state := circuitBreakerState{}
+	if err := json.Unmarshal([]byte(jsonState), &state); err != nil {
+		return err
+	}
+	if b.CircuitBreaker.restore(state) {
+		telemetry.CircuitBreakerState.WithLabelValues(b.ServicePrefix, b.URL.String()).Set(stateValue(state.State))
+	}
+	return nil
+}
+
+// saveCircuitState shares the circuit breaker state into health cells bucket, one save at a time so the last
+// state is the one kept
+func (b *Backend) saveCircuitState() error {
+	b.circuitMux.Lock()
+	defer b.circuitMux.Unlock()
+	jsonState, err := json.Marshal(b.CircuitBreaker)
+	if err != nil {
+		return err
+	}
+	return putHealthCell(BucketHealthCells, b.circuitStateKey(), string(jsonState))
+}
+
+// readState reads a backend state from health cells bucket, nil when it doesn't exist
+func readState(key string) (*Backend, error) {
+	jsonBackend, err := getHealthCell(BucketHealthCells, key)
+	if err != nil {
+		switch err.(type) {
+		case errApp.NotFoundError: // Not checked yet
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	state := &Backend{}
+	if _, err := util.StringToObject(jsonBackend, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveState shares the backend state into health cells bucket
+func (b *Backend) saveState() error {
+	b.mux.RLock()
+	jsonBackend, err := json.Marshal(b)
+	b.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+	return putHealthCell(BucketHealthCells, b.stateKey(), string(jsonBackend))
+}
+
 // ServerPool holds information about reachable backends
 type ServerPool struct {
-	ServicePrefix string
-	backends      []*Backend
-	current       uint64
+	ServicePrefix   string
+	backends        []*Backend
+	balancer        Balancer
+	stickySession   *StickySession
+	zoneAwareness   *ZoneAwareness
+	slowStart       *SlowStart
+	outlierDetector *OutlierDetector
+	retryPolicy     *RetryPolicy
+	retryBudget     *RetryBudget
+	hedging         *HedgingPolicy
+	timeouts        Timeouts
+	connections     *ConnectionPool
+	client          *http.Client
+	healthClient    *http.Client
+	headersDisabled func(string) bool
+	websocket       config.WebSocket
+	streaming       *Streaming
+	streamClient    *http.Client
+	grpcClient      *http.Client
+	cors            *CorsPolicy
+	rewriter        *Rewriter
+}
+
+func NewServerPool(service config.Service) (*ServerPool, error) {
+	balancer, err := NewBalancer(service)
+	if err != nil {
+		return nil, err
+	}
+	serverPool := &ServerPool{ServicePrefix: service.ServicePrefix, balancer: balancer, retryPolicy: NewRetryPolicy(service.Retry)}
+	if service.StickySession.Enabled {
+		serverPool.stickySession = NewStickySession(service.ServicePrefix, service.StickySession)
+	}
+	if service.ZoneAware.Enabled && config.ConfigObj.App.ZoneAws != "" {
+		serverPool.zoneAwareness = NewZoneAwareness(config.ConfigObj.App.ZoneAws, service.ZoneAware)
+	}
+	if service.SlowStart.Window > 0 {
+		serverPool.slowStart = NewSlowStart(service.SlowStart)
+	}
+	if service.OutlierDetection.Enabled {
+		serverPool.outlierDetector = NewOutlierDetector(service.OutlierDetection)
+	}
+	if service.RetryBudget.Enabled {
+		serverPool.retryBudget = NewRetryBudget(service.RetryBudget)
+	}
+	if service.Hedging.Enabled {
+		serverPool.hedging, err = NewHedgingPolicy(service.Hedging)
+		if err != nil {
+			return nil, err
+		}
+	}
+	serverPool.websocket = service.WebSocket
+	if serverPool.websocket.IdleTimeout <= 0 {
+		serverPool.websocket.IdleTimeout = DefaultTunnelIdleTimeout
+	}
+	if serverPool.websocket.MaxDuration <= 0 {
+		serverPool.websocket.MaxDuration = DefaultTunnelMaxDuration
+	}
+	serverPool.headersDisabled = HeadersDisabledInRedirection(service.HeadersDisabledInRedirection)
+	serverPool.timeouts = NewTimeouts(service.Timeouts)
+	connections, err := NewConnectionPool(service.ServicePrefix, service.Transport, serverPool.timeouts)
+	if err != nil {
+		return nil, err
+	}
+	serverPool.connections = connections
+	serverPool.client = connections.Client()
+	serverPool.streaming = NewStreaming(service.Streaming)
+	serverPool.streamClient = connections.StreamClient()
+	serverPool.grpcClient = connections.GrpcClient()
+	serverPool.healthClient = &http.Client{Timeout: serverPool.timeouts.HealthCheck}
+	rewriter, err := NewRewriter(service.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	serverPool.rewriter = rewriter
+	if service.CORS.Enabled {
+		serverPool.cors, err = NewCorsPolicy(service.CORS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return serverPool, nil
 }
 
 // AddBackend to the server pool
 func (s *ServerPool) AddBackend(backend *Backend) {
 	s.backends = append(s.backends, backend)
+	if ring, ok := s.balancer.(*ConsistentHashBalancer); ok {
+		ring.add(backend)
+	}
 }
 
 // Pools by prefix
 type ServerPools struct {
-	ServerPoolByPrefix  map[string]*ServerPool
+	ServerPoolByPrefix map[string]*ServerPool
+	// Deprecated: a zone has the backends of many pools, so it isn't filled. Zone awareness uses the zone of
+	// each backend instead.
 	ServerPoolByAwsZone map[string]*ServerPool
 }
 
@@ -153,6 +456,7 @@ func (s *ServerPools) AddServerPoolByPrefix(servicePrefix string, serverPool *Se
 	s.ServerPoolByPrefix[servicePrefix] = serverPool
 }
 
+// Deprecated: see ServerPoolByAwsZone.
 func (s *ServerPools) AddServerPoolByAwsZone(prefix string, serverPool *ServerPool) {
 	s.ServerPoolByAwsZone[prefix] = serverPool
 }
@@ -161,52 +465,138 @@ func (s *ServerPools) GetServerPoolByPrefix(prefix string) *ServerPool {
 	return s.ServerPoolByPrefix[prefix]
 }
 
-// NextIndex atomically increase the counter and return an index
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+// GetNextBackend returns next active backend to take a connection, other than the excluded ones
+func (s *ServerPool) GetNextBackend(r *http.Request, excluded ...*Backend) *Backend {
+	healthy := s.healthyBackends()
+	for _, b := range excluded {
+		healthy = withoutBackend(healthy, b)
+	}
+	tier, healthy := priorityTier(s.backends, healthy)
+	for len(healthy) > 0 {
+		b := s.selectBackend(tier, healthy, r)
+		// Half open breakers let only a few trials pass, so other backend is taken when they are taken
+		if b == nil || b.CircuitBreaker.Allow() {
+			return b
+		}
+		healthy = withoutBackend(healthy, b)
+	}
+	return nil
 }
 
-// GetNextBackend returns next active backend to take a connection
-func (s *ServerPool) GetNextBackend() *Backend {
-	// loop entire backends to find out an Alive backend
-	next := s.NextIndex()
-	l := len(s.backends) + next // start from next and move a full cycle
-	for i := next; i < l; i++ {
-		idx := i % len(s.backends) // take an index by modding
-		b := s.backends[idx]
+// selectBackend chooses the backend between the healthy ones of the priority tier
+func (s *ServerPool) selectBackend(tier []*Backend, healthy []*Backend, r *http.Request) *Backend {
+	if s.stickySession != nil {
+		// Pinned backend while it's alive, otherwise fail over to balancer
+		if b := s.stickySession.Backend(r, healthy); b != nil {
+			return b
+		}
+	}
+	if s.zoneAwareness != nil {
+		healthy = s.zoneAwareness.Filter(tier, healthy)
+	}
 
-		// Reading from bucket
-		serverId := fmt.Sprintf("servers-%s", b.ServicePrefix)
-		bStrObject, err := repository.GetStringObject(BucketHealthCells, serverId)
-		if err != nil {
-			log.Err(err)
-			continue
+	b := s.balancer.Next(healthy, r)
+	if s.slowStart != nil && b != nil {
+		// Backend into slow start takes only its fraction of requests, the others go to the warmed backends
+		if factor := s.slowStart.Factor(b); factor < 1 && rand.Float64() >= factor {
+			if warmed := s.slowStart.Warmed(healthy); len(warmed) > 0 {
+				return s.balancer.Next(warmed, r)
+			}
 		}
+	}
+	return b
+}
 
-		_, err2 := util.StringToObject(bStrObject, b)
-		if err2 != nil {
-			log.Err(err2)
-			continue
+func withoutBackend(backends []*Backend, backend *Backend) []*Backend {
+	others := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b != backend {
+			others = append(others, b)
 		}
+	}
+	return others
+}
 
-		if b.IsAlive() { // if we have an alive backend, use it and store if its not the original one
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.backends[idx]
+// priorityTier returns the backends of the highest priority tier that has healthy backends, and the healthy ones.
+// Lower values are higher priorities, so backup servers take requests only when the primary ones are down.
+func priorityTier(backends []*Backend, healthy []*Backend) ([]*Backend, []*Backend) {
+	if len(healthy) == 0 {
+		return backends, healthy
+	}
+
+	priority := healthy[0].Priority
+	for _, b := range healthy {
+		if b.Priority < priority {
+			priority = b.Priority
 		}
 	}
-	return nil
+
+	var tier, tierHealthy []*Backend
+	for _, b := range backends {
+		if b.Priority == priority {
+			tier = append(tier, b)
+		}
+	}
+	for _, b := range healthy {
+		if b.Priority == priority {
+			tierHealthy = append(tierHealthy, b)
+		}
+	}
+	return tier, tierHealthy
 }
 
-func (s *ServerPool) HandleRequest(c *gin.Context, pathUri string, method string, headers map[string][]string) error {
+// onResult records the result of a request to the backend
+func (s *ServerPool) onResult(b *Backend, statusCode int, err error) {
+	failure := err != nil || statusCode >= http.StatusInternalServerError
+	if failure {
+		b.CountsRequests.onFailure()
+	} else {
+		b.CountsRequests.onSuccess()
+	}
+	b.CircuitBreaker.OnResult(failure)
+	if s.outlierDetector != nil {
+		s.outlierDetector.OnResult(s.backends, b, statusCode, err)
+	}
+}
 
-	peer := s.GetNextBackend()
-	if peer == nil {
-		return errApp.NewGenericError("No backend servers was found", nil)
+// detectOutliers runs the success rate analysis of the outlier detection every interval
+func (s *ServerPool) detectOutliers() {
+	t := time.NewTicker(s.outlierDetector.config.Interval)
+	for range t.C {
+		s.outlierDetector.Analyze(s.backends)
 	}
+}
 
-	requestUri := fmt.Sprintf("%s%s", peer.URL.String(), pathUri)
+// healthyBackends refreshes the state of the backends and returns the alive ones
+func (s *ServerPool) healthyBackends() []*Backend {
+	healthy := make([]*Backend, 0, len(s.backends))
+	for _, b := range s.backends {
+		if err := b.loadState(); err != nil {
+			log.Err(err).Str("server", b.URL.String()).Msg("Error to load the backend state")
+			continue
+		}
+		alive := b.IsAlive()
+		b.observeAlive(alive)
+		if alive {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// proxyRequest holds the request of the client that is sent to the backends
+type proxyRequest struct {
+	c            *gin.Context
+	pathUri      string
+	upstreamPath string
+	method       string
+	headers      map[string][]string
+	body         func() io.Reader
+	client       *http.Client
+	deadline     *requestDeadline
+}
+
+func (s *ServerPool) HandleRequest(c *gin.Context, pathUri string, method string, headers map[string][]string) error {
 
 	// Tracing this request
 	ctx, span := tracer.Start(c.Request.Context(), "HandleRequest", trace.WithAttributes(
@@ -215,44 +605,304 @@ func (s *ServerPool) HandleRequest(c *gin.Context, pathUri string, method string
 
 	defer span.End()
 
-	client := &http.Client{}
-	req, err := http.NewRequestWithContext(ctx, method, requestUri, c.Request.Body)
+	// Preflights are answered by the router
+	if s.cors != nil {
+		if IsPreflight(c.Request) {
+			s.cors.HandlePreflight(c.Writer, c.Request)
+			return nil
+		}
+		s.cors.SetHeaders(c.Writer.Header(), c.Request)
+	}
+
+	// Upgraded connections are tunneled without the timeout of the requests
+	if upgradeType(c.Request.Header) != "" {
+		pr := &proxyRequest{c: c, pathUri: pathUri, upstreamPath: s.rewriter.Rewrite(pathUri), method: method, headers: headers, body: func() io.Reader { return nil }, client: s.client}
+		return s.handleUpgrade(ctx, pr)
+	}
+
+	// Limits the request to the timeout of the pool. Client disconnections cancel the request context too.
+	// Streaming paths have the idle timeout instead, so long-polls can wait the response, and are closed on
+	// shutdown even before the headers arrive.
+	client := s.client
+	var deadline *requestDeadline
+	if s.streaming.Route(pathUri) {
+		client = s.streamClient
+		deadline = newRequestDeadline(ctx, 0)
+		deadline.stream(s.streaming.idleTimeout)
+		Streams.add(deadline)
+		defer Streams.remove(deadline)
+	} else {
+		if IsGrpc(c.Request.Header) {
+			client = s.grpcClient
+		}
+		deadline = newRequestDeadline(ctx, s.timeouts.RequestTimeout(c.Request))
+	}
+	defer deadline.cancel()
+	ctx = deadline
+
+	body, attempts, err := s.retryPolicy.RequestBody(c.Request, s.retryPolicy.Attempts(c.Request))
 	if err != nil {
-		return errApp.NewGenericError("Error to create request", err)
+		return errApp.NewBadRequestErrorWithCause("Error to read request body", err)
 	}
+	pr := &proxyRequest{c: c, pathUri: pathUri, upstreamPath: s.rewriter.Rewrite(pathUri), method: method, headers: headers, body: body, client: client, deadline: deadline}
 
-	// Set trace id
-	req.Header.Set(constant.TraceIdHeaderName, c.GetString(constant.TraceIdHeaderName))
-	// Copying headers
-	for name, values := range headers {
-		for _, value := range values {
-			log.Debug().Str(name, value).Msg("Iterating headers...")
-			if found := HeadersDisabledInRedirection()(name); !found {
-				req.Header.Set(name, value)
+	peer := s.GetNextBackend(c.Request)
+	if peer == nil {
+		return errApp.NewGenericError("No backend servers was found", nil)
+	}
+	tried := []*Backend{peer}
+	if s.retryBudget != nil {
+		s.retryBudget.OnRequest()
+	}
+
+	for attempt := 1; ; attempt++ {
+		result := s.attempt(ctx, pr, peer, tried, attempt)
+		if result.hedge != nil {
+			tried = append(tried, result.hedge)
+		}
+		peer = result.peer
+		if ctx.Err() != nil {
+			result.close()
+			return contextError(c, ctx)
+		}
+
+		// Retries go to other backend, keeping the last result when there isn't one or the budget is exhausted
+		budgetExhausted := false
+		if attempt < attempts && s.retryPolicy.ShouldRetry(result.resp, result.err) {
+			next := s.GetNextBackend(c.Request, tried...)
+			if next != nil && !s.allowRetry() {
+				budgetExhausted = true
+				next = nil
+			}
+			if next != nil {
+				result.close()
+				if !sleep(ctx, s.retryPolicy.Backoff(attempt)) {
+					return contextError(c, ctx)
+				}
+				peer = next
+				tried = append(tried, next)
+				continue
 			}
 		}
+
+		defer result.close()
+		span.SetAttributes(attribute.Int("attempts", attempt))
+		if budgetExhausted {
+			c.Header(constant.RetryBudgetHeaderName, "true")
+		}
+		if result.err != nil {
+			if budgetExhausted {
+				return errApp.NewIntegrationError("Error to call API, retry budget exhausted", result.err)
+			}
+			return errApp.NewIntegrationError("Error to call API", result.err)
+		}
+		return s.writeResponse(pr, peer, result.resp)
 	}
+}
 
-	resp, err := client.Do(req) // Call API
+// contextError returns the error of a request that timed out or was canceled by the client or the router
+func contextError(c *gin.Context, ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errApp.NewTimeoutError("Request timed out", ctx.Err())
+	}
+	if c.Request.Context().Err() != nil {
+		log.Debug().Msg("Request canceled by the client.")
+		return errApp.NewIntegrationError("Request canceled by the client", ctx.Err())
+	}
+	return errApp.NewUnavailableError("Request canceled by the router", ctx.Err())
+}
+
+// allowRetry takes a retry from the budget of the pool
+func (s *ServerPool) allowRetry() bool {
+	if s.retryBudget != nil && !s.retryBudget.TryRetry() {
+		log.Warn().Str("prefix", s.ServicePrefix).Msg("Retry budget exhausted.")
+		telemetry.RetryBudgetExhausted.WithLabelValues(s.ServicePrefix).Inc()
+		return false
+	}
+	telemetry.Retries.WithLabelValues(s.ServicePrefix).Inc()
+	return true
+}
+
+// attemptResult holds the result of an attempt, in flight until it's closed
+type attemptResult struct {
+	peer   *Backend
+	hedge  *Backend
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+// close releases the response and the backend of the attempt
+func (r *attemptResult) close() {
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+	r.cancel()
+	r.peer.endRequest()
+}
+
+// attempt sends the request to the backend, hedging it when the hedging policy of the pool applies
+func (s *ServerPool) attempt(ctx context.Context, pr *proxyRequest, peer *Backend, tried []*Backend, attempt int) *attemptResult {
+	if s.hedging != nil && s.hedging.Applies(pr.c.Request) {
+		return s.hedge(ctx, pr, peer, tried, attempt)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return s.send(ctx, cancel, pr, peer, attempt, false)
+}
+
+// send does the request to the backend, keeping it in flight until the result is closed
+func (s *ServerPool) send(ctx context.Context, cancel context.CancelFunc, pr *proxyRequest, peer *Backend, attempt int, hedge bool) *attemptResult {
+	peer.startRequest()
+	resp, err := s.doAttempt(ctx, pr, peer, attempt, hedge)
+	return &attemptResult{peer: peer, resp: resp, err: err, cancel: cancel}
+}
+
+// newUpstreamRequest builds the request of the client to the backend
+func (s *ServerPool) newUpstreamRequest(ctx context.Context, pr *proxyRequest, peer *Backend) (*http.Request, error) {
+	// Rewritten path on the backend URL, with the query string of the client
+	requestUrl := *peer.URL
+	requestUrl.Path = strings.TrimSuffix(requestUrl.Path, "/") + pr.upstreamPath
+	requestUrl.RawPath = ""
+	requestUrl.RawQuery = pr.c.Request.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, pr.method, requestUrl.String(), pr.body())
 	if err != nil {
-		return errApp.NewIntegrationError("Error to call API", err)
+		return nil, err
 	}
+	// Streamed bodies keep the length of the client request, or are sent chunked when it's unknown
+	if req.ContentLength == 0 && req.Body != nil && req.Body != http.NoBody {
+		req.ContentLength = pr.c.Request.ContentLength
+	}
+	req.Trailer = pr.c.Request.Trailer
 
-	defer resp.Body.Close() // Defer will close after this function ends
-	body, err := ioutil.ReadAll(resp.Body)
+	// Copying headers, keeping all values of each one
+	for name, values := range pr.headers {
+		if !s.headersDisabled(name) {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+	removeHopHeaders(req.Header)
+	addForwardedHeaders(req.Header, pr.c.Request, config.ConfigObj.App.Name)
+	// Set trace id
+	req.Header.Set(constant.TraceIdHeaderName, pr.c.GetString(constant.TraceIdHeaderName))
+	// Propagates the remaining time of the request
+	setDeadlineHeader(ctx, req.Header)
+	return req, nil
+}
+
+// doAttempt sends the request to the backend
+func (s *ServerPool) doAttempt(ctx context.Context, pr *proxyRequest, peer *Backend, attempt int, hedge bool) (*http.Response, error) {
+	ctx = context.WithValue(context.WithValue(ctx, Attempts, attempt), Retry, attempt-1)
+	ctx, span := tracer.Start(ctx, "Attempt", trace.WithAttributes(
+		attribute.String("server", peer.URL.String()),
+		attribute.Int("attempt", attempt),
+		attribute.Bool("hedge", hedge)),
+	)
+
+	defer span.End()
+
+	req, err := s.newUpstreamRequest(ctx, pr, peer)
 	if err != nil {
-		errApp.NewIntegrationError("Error read response body", err)
+		return nil, err
 	}
 
-	c.Data(resp.StatusCode, resp.Header.Get(constant.ContentTypeHeaderName), body) // Data is returned
+	peer.CountsRequests.onRequest()
+	start := time.Now()
+	resp, err := pr.client.Do(req) // Call API
+	if err != nil {
+		span.RecordError(err)
+		// Requests canceled by the router or the client don't say anything about the backend
+		if !errors.Is(err, context.Canceled) {
+			s.onResult(peer, 0, err)
+		}
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	peer.latency.Observe(elapsed)
+	if s.hedging != nil {
+		s.hedging.latencies.Observe(elapsed)
+	}
+	span.SetAttributes(attribute.Int("status_code", resp.StatusCode))
+	if IsGrpc(resp.Header) {
+		// The gRPC status comes in the headers of trailers only responses, otherwise it's recorded when the body ends
+		if code, ok := grpcStatus(resp.Header); ok {
+			span.SetAttributes(attribute.Int("grpc_status", code))
+			s.onGrpcResult(peer, code)
+		}
+		return resp, nil
+	}
+	s.onResult(peer, resp.StatusCode, nil)
+	return resp, nil
+}
+
+// writeResponse returns the response of the backend to the client
+func (s *ServerPool) writeResponse(pr *proxyRequest, peer *Backend, resp *http.Response) error {
+	c := pr.c
+	if s.stickySession != nil {
+		s.stickySession.SetCookie(c.Writer, c.Request, peer)
+	}
+
+	defer resp.Body.Close() // Defer will close after this function ends
+
+	removeHopHeaders(resp.Header)
+	if s.cors != nil {
+		removeCorsHeaders(resp.Header)
+	}
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, config.ConfigObj.App.Name)
+	header := c.Writer.Header()
+	copyHeader(header, resp.Header)
+	announced := announceTrailers(header, resp.Trailer)
+	c.Status(resp.StatusCode)
+	c.Writer.WriteHeaderNow()
+
+	// Responses without length are flushed as they arrive
+	_, trailersOnly := grpcStatus(resp.Header)
+	grpcStream := IsGrpc(resp.Header) && !trailersOnly
+
+	// Event streams have the idle timeout instead of the timeout of the request, and are closed on shutdown
+	var body io.Reader = resp.Body
+	streaming := isEventStream(resp.Header) || s.streaming.Route(pr.pathUri)
+	if streaming && pr.deadline != nil {
+		pr.deadline.stream(s.streaming.idleTimeout)
+		Streams.add(pr.deadline)
+		defer Streams.remove(pr.deadline)
+		body = idleReader{Reader: resp.Body, deadline: pr.deadline}
+	}
 
+	_, err := streamBody(c.Writer, body, resp.ContentLength == -1 || grpcStream || streaming)
+	if err != nil {
+		if grpcStream && !errors.Is(err, context.Canceled) {
+			s.onResult(peer, 0, err)
+		}
+		// The status was already sent, the client only sees the truncated body
+		if pr.deadline != nil && pr.deadline.Err() != nil {
+			log.Debug().Err(pr.deadline.Err()).Str("server", peer.URL.String()).Msg("Response body stream ended.")
+			return nil
+		}
+		log.Warn().Err(err).Str("server", peer.URL.String()).Msg("Error to stream response body.")
+		trace.SpanFromContext(c.Request.Context()).RecordError(err)
+		return nil
+	}
+	copyTrailers(header, resp.Trailer, announced)
+	if grpcStream {
+		code, ok := grpcStatus(resp.Trailer)
+		if !ok {
+			// Streams that end without status are broken
+			s.onResult(peer, http.StatusBadGateway, nil)
+			return nil
+		}
+		s.onGrpcResult(peer, code)
+	}
 	return nil
 }
 
 // doHealthCheck pings the backends and update the status
 func (s *ServerPool) doHealthCheck() {
 	for _, b := range s.backends {
-		b.doHealthCheck()
+		b.doHealthCheck(s.healthClient)
+		if err := b.loadCircuitState(); err != nil {
+			log.Err(err).Str("server", b.URL.String()).Msg("Error to load the circuit breaker state")
+		}
 	}
 }
 
@@ -275,10 +925,10 @@ func GetRetryFromContext(r *http.Request) int {
 var tracer = otel.Tracer(config.ConfigObj.App.Name)
 
 // isAlive checks whether a backend is Alive by establishing a TCP connection
-func (b *Backend) doHealthCheck() error {
+func (b *Backend) doHealthCheck(client *http.Client) error {
 
 	if b.HealthCheck.Type == HealthCheckDialUp {
-		timeout := 2 * time.Second
+		timeout := client.Timeout
 		var address = b.URL.Host
 		if !strings.Contains(address, ":") {
 			address = fmt.Sprintf("%s:%s", address, "80")
@@ -294,26 +944,26 @@ func (b *Backend) doHealthCheck() error {
 		}
 	} else {
 		b.CountsHealthChecks.onRequest()
-		resp, err := http.Get(b.HealthCheck.Endpoint)
+		resp, err := client.Get(b.HealthCheck.Endpoint)
 		if err != nil {
 			log.Warn().Err(err).Msg("Server healthcheck error.")
 			b.CountsHealthChecks.onFailure()
-		} else if resp.StatusCode == http.StatusOK {
-			b.CountsHealthChecks.onSuccess()
 		} else {
-			b.CountsHealthChecks.onFailure()
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				b.CountsHealthChecks.onSuccess()
+			} else {
+				b.CountsHealthChecks.onFailure()
+			}
 		}
 	}
 
+	b.mux.Lock()
+	b.Alive = b.CountsHealthChecks.ConsecutiveFailures < MaxRetries
 	b.UpdateDate = time.Now()
+	b.mux.Unlock()
 
-	jsonBackend, err := json.Marshal(b)
-	if err != nil {
-		return err
-	}
-	serverId := fmt.Sprintf("servers-%s", b.ServicePrefix)
-	repository.PutStringObject(BucketHealthCells, serverId, string(jsonBackend))
-	return nil
+	return b.saveState()
 }
 
 // healthCheck runs a routine for check status of the backends every 30 seconds
@@ -332,18 +982,8 @@ func healthCheck() {
 	}
 }
 
-func HeadersDisabledInRedirection() func(string) bool {
-	innerMap := map[string]int{
-		"Accept-Encoding": 1, // This header transform encodings
-	}
-	return func(key string) bool {
-
-		_, found := innerMap[key]
-		return found
-	}
-}
-
 func Setup() error {
+	rand.Seed(time.Now().UnixNano())
 
 	serversConfig := config.ConfigObj.Servers
 
@@ -354,54 +994,83 @@ func Setup() error {
 			return err
 		}
 
-		var serverPool *ServerPool
-		serverPool = ServerPoolsObj.GetServerPoolByPrefix(server.ServicePrefix)
+		service := config.ConfigObj.GetService(server.ServicePrefix)
+		serverPool := ServerPoolsObj.GetServerPoolByPrefix(server.ServicePrefix)
 		if serverPool == nil {
 			// Init Server Pool
-			serverPool = &ServerPool{ServicePrefix: server.ServicePrefix}
-			ServerPoolsObj.AddServerPoolByPrefix(server.ServicePrefix, serverPool)
-		}
-
-		// Update status status from cache db
-		serverId := fmt.Sprintf("servers-%s", server.ServicePrefix)
-
-		jsonServer, err := repository.GetStringObject(BucketHealthCells, serverId)
-
-		var alive = false
-		if err != nil {
-			switch err.(type) {
-			case errApp.NotFoundError:
-				alive = true
-			default:
+			serverPool, err = NewServerPool(service)
+			if err != nil {
 				return err
 			}
+			ServerPoolsObj.AddServerPoolByPrefix(server.ServicePrefix, serverPool)
 		}
 
-		var countsRequests = Counts{}
-		var countsHealthChecks = Counts{}
-
-		if len(jsonServer) > 0 {
-			b := Backend{}
-			json.Unmarshal([]byte(jsonServer), &b)
-			countsRequests = *b.CountsRequests
-			countsHealthChecks = *b.CountsHealthChecks
+		weight := server.Weight
+		if weight <= 0 {
+			weight = DefaultWeight
 		}
 
-		// Add server to serverpool
-		serverPool.AddBackend(&Backend{
+		backend := &Backend{
 			ServicePrefix:      server.ServicePrefix,
 			URL:                serverUrl,
 			ZoneAws:            server.ZoneAws,
+			Weight:             weight,
+			Priority:           server.Priority,
 			HealthCheck:        newHealthcheck(server.HealthCheck.Type, server.HealthCheck.Endpoint),
-			Alive:              alive,
-			CountsRequests:     &countsRequests,
-			CountsHealthChecks: &countsHealthChecks},
-		)
+			Alive:              true,
+			CountsRequests:     &Counts{},
+			CountsHealthChecks: &Counts{},
+			latency:            NewPeakEwma(service.EwmaDecay),
+			upSince:            time.Now(),
+			wasAlive:           true,
+		}
+		backend.CircuitBreaker = NewCircuitBreaker(service.CircuitBreaker, backend.onCircuitStateChange)
+
+		// Update status from cache db
+		if err := backend.restoreState(); err != nil {
+			return err
+		}
+
+		// Add server to serverpool
+		serverPool.AddBackend(backend)
+	}
+
+	// Route table, with the pools of the servers
+	routeTable, err := NewRouteTable(config.ConfigObj.Routes)
+	if err != nil {
+		return err
+	}
+	for _, route := range routeTable.routes {
+		if ServerPoolsObj.GetServerPoolByPrefix(route.servicePrefix) == nil {
+			return errApp.NewGenericError(fmt.Sprintf("Route to the prefix \"%s\" without servers", route.servicePrefix), nil)
+		}
+	}
+	RouteTableObj = routeTable
+
+	// gRPC services, with the pools of the servers
+	for _, grpcService := range config.ConfigObj.GrpcServices {
+		if ServerPoolsObj.GetServerPoolByPrefix(grpcService.ServicePrefix) == nil {
+			return errApp.NewGenericError(fmt.Sprintf("gRPC service \"%s\" routed to the prefix \"%s\" without servers", grpcService.Service, grpcService.ServicePrefix), nil)
+		}
 	}
 
 	// start health checking
 	go healthCheck()
 
+	// start outlier detection
+	for _, serverPool := range ServerPoolsObj.ServerPoolByPrefix {
+		if serverPool.outlierDetector != nil {
+			go serverPool.detectOutliers()
+		}
+	}
+
+	// start renewal of upstream connections
+	for _, serverPool := range ServerPoolsObj.ServerPoolByPrefix {
+		if serverPool.connections.maxConnLifetime > 0 {
+			go serverPool.connections.recycleConnections()
+		}
+	}
+
 	return nil
 }
 
@@ -1 +1,1186 @@
 package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ortisan/router-go/internal/config"
+	"github.com/ortisan/router-go/internal/constant"
+	errApp "github.com/ortisan/router-go/internal/error"
+	"github.com/ortisan/router-go/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTestBackend(host string) *Backend {
+	b := &Backend{
+		ServicePrefix:      "app1",
+		URL:                &url.URL{Scheme: "http", Host: host},
+		Weight:             DefaultWeight,
+		Alive:              true,
+		CountsRequests:     &Counts{},
+		CountsHealthChecks: &Counts{},
+		latency:            NewPeakEwma(DefaultEwmaDecay),
+	}
+	b.CircuitBreaker = NewCircuitBreaker(config.CircuitBreaker{}, nil)
+	return b
+}
+
+func TestNewBalancer(t *testing.T) {
+	balancer, err := NewBalancer(config.Service{ServicePrefix: "app1"})
+	assert.Nil(t, err)
+	assert.IsType(t, &RoundRobinBalancer{}, balancer)
+
+	balancer, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyRandom})
+	assert.Nil(t, err)
+	assert.IsType(t, &RandomBalancer{}, balancer)
+
+	balancer, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyWeighted})
+	assert.Nil(t, err)
+	assert.IsType(t, &WeightedRoundRobinBalancer{}, balancer)
+
+	balancer, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyLeastRequests})
+	assert.Nil(t, err)
+	assert.IsType(t, &LeastRequestsBalancer{}, balancer)
+
+	balancer, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyPeakEwma})
+	assert.Nil(t, err)
+	assert.IsType(t, &PeakEwmaBalancer{}, balancer)
+
+	balancer, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyConsistentHash})
+	assert.Nil(t, err)
+	assert.IsType(t, &ConsistentHashBalancer{}, balancer)
+
+	_, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: StrategyConsistentHash, HashKey: config.HashKey{Type: HashKeyTypeHeader}})
+	assert.NotNil(t, err)
+
+	_, err = NewBalancer(config.Service{ServicePrefix: "app1", Strategy: "xpto"})
+	assert.NotNil(t, err)
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := []*Backend{newTestBackend("server1"), newTestBackend("server2")}
+	balancer := &RoundRobinBalancer{}
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+
+	assert.Equal(t, backends[1], balancer.Next(backends, req))
+	assert.Equal(t, backends[0], balancer.Next(backends, req))
+	assert.Equal(t, backends[1], balancer.Next(backends, req))
+	assert.Nil(t, balancer.Next([]*Backend{}, req))
+}
+
+func TestRandomBalancer(t *testing.T) {
+	backends := []*Backend{newTestBackend("server1"), newTestBackend("server2")}
+	balancer := &RandomBalancer{}
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+
+	assert.Contains(t, backends, balancer.Next(backends, req))
+	assert.Nil(t, balancer.Next([]*Backend{}, req))
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	a, b, c := newTestBackend("a"), newTestBackend("b"), newTestBackend("c")
+	a.Weight = 5
+	backends := []*Backend{a, b, c}
+	balancer := NewWeightedRoundRobinBalancer()
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+
+	// Sequence of nginx smooth weighted round robin for weights 5, 1, 1
+	expected := []*Backend{a, a, b, a, c, a, a}
+	for _, backend := range expected {
+		assert.Equal(t, backend, balancer.Next(backends, req))
+	}
+
+	// Without the backend a, b and c keep the same ratio
+	counts := map[*Backend]int{}
+	for i := 0; i < 10; i++ {
+		counts[balancer.Next([]*Backend{b, c}, req)]++
+	}
+	assert.Equal(t, 5, counts[b])
+	assert.Equal(t, 5, counts[c])
+}
+
+func TestLeastRequestsBalancer(t *testing.T) {
+	a, b, c := newTestBackend("a"), newTestBackend("b"), newTestBackend("c")
+	a.startRequest()
+	a.startRequest()
+	b.startRequest()
+	balancer := &LeastRequestsBalancer{}
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+
+	assert.Equal(t, c, balancer.Next([]*Backend{a, b, c}, req))
+
+	c.startRequest()
+	assert.Contains(t, []*Backend{b, c}, balancer.Next([]*Backend{a, b, c}, req))
+
+	b.endRequest()
+	assert.Equal(t, b, balancer.Next([]*Backend{a, b, c}, req))
+	assert.Nil(t, balancer.Next([]*Backend{}, req))
+}
+
+func TestPeakEwma(t *testing.T) {
+	ewma := NewPeakEwma(time.Second)
+	assert.Equal(t, float64(0), ewma.Value())
+
+	ewma.Observe(100 * time.Millisecond)
+	assert.InDelta(t, float64(100*time.Millisecond), ewma.Value(), float64(time.Millisecond))
+
+	// Peaks are taken right away
+	ewma.Observe(time.Second)
+	assert.InDelta(t, float64(time.Second), ewma.Value(), float64(10*time.Millisecond))
+
+	// Lower response times only pull the average down
+	ewma.Observe(10 * time.Millisecond)
+	assert.Greater(t, ewma.Value(), float64(500*time.Millisecond))
+}
+
+func TestPeakEwmaBalancer(t *testing.T) {
+	fast, slow := newTestBackend("fast"), newTestBackend("slow")
+	fast.latency.Observe(10 * time.Millisecond)
+	slow.latency.Observe(time.Second)
+	balancer := &PeakEwmaBalancer{}
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, fast, balancer.Next([]*Backend{fast, slow}, req))
+	}
+	assert.Equal(t, slow, balancer.Next([]*Backend{slow}, req))
+	assert.Nil(t, balancer.Next([]*Backend{}, req))
+
+	// Backends without response times take the mean of the pool, instead of winning all the picks
+	fresh := newTestBackend("fresh")
+	seed := balancer.seed([]*Backend{fast, slow, fresh})
+	assert.InDelta(t, float64(505*time.Millisecond), seed, float64(time.Millisecond))
+	assert.Greater(t, fresh.cost(seed), fast.cost(seed))
+	assert.Less(t, fresh.cost(seed), slow.cost(seed))
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, slow, balancer.Next([]*Backend{fast, slow, fresh}, req))
+	}
+	balancer = NewPeakEwmaBalancer(config.Service{})
+	assert.Equal(t, float64(DefaultEwmaInitialRtt), balancer.seed([]*Backend{fresh}))
+
+	// Recovered backends drop the response times from before they were down
+	fast.observeAlive(false)
+	fast.observeAlive(true)
+	assert.False(t, fast.latency.Sampled())
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	backends := []*Backend{newTestBackend("a"), newTestBackend("b"), newTestBackend("c")}
+	balancer, _ := NewConsistentHashBalancer(config.Service{ServicePrefix: "app1", HashKey: config.HashKey{Type: HashKeyTypeHeader, Name: "x-user-id"}})
+
+	chosen := map[string]*Backend{}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/api/app1", nil)
+		req.Header.Set("x-user-id", fmt.Sprintf("user-%d", i))
+		chosen[req.Header.Get("x-user-id")] = balancer.Next(backends, req)
+		assert.Equal(t, chosen[req.Header.Get("x-user-id")], balancer.Next(backends, req))
+	}
+
+	// Only the keys of the removed backend are remapped
+	for user, backend := range chosen {
+		req := httptest.NewRequest("GET", "/api/app1", nil)
+		req.Header.Set("x-user-id", user)
+		next := balancer.Next(backends[1:], req)
+		if backend != backends[0] {
+			assert.Equal(t, backend, next)
+		} else {
+			assert.NotEqual(t, backends[0], next)
+		}
+	}
+}
+
+func TestConsistentHashBalancerConcurrent(t *testing.T) {
+	backends := []*Backend{newTestBackend("a"), newTestBackend("b"), newTestBackend("c"), newTestBackend("d")}
+	balancer, _ := NewConsistentHashBalancer(config.Service{ServicePrefix: "app1", HashKey: config.HashKey{Type: HashKeyTypeHeader, Name: "x-user-id"}})
+
+	// Calls with different candidates, like the retries without the tried backends, only get their candidates
+	done := make(chan bool)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			defer func() { done <- true }()
+			candidates := append(append([]*Backend{}, backends[:g%4]...), backends[g%4+1:]...)
+			for i := 0; i < 2000; i++ {
+				req := httptest.NewRequest("GET", "/api/app1", nil)
+				req.Header.Set("x-user-id", strconv.Itoa(i))
+				if next := balancer.Next(candidates, req); !assert.Contains(t, candidates, next) {
+					return
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		<-done
+	}
+	assert.Len(t, balancer.hashes, 4*DefaultVirtualNodes)
+}
+
+func TestStickySession(t *testing.T) {
+	backends := []*Backend{newTestBackend("a"), newTestBackend("b")}
+	stickySession := NewStickySession("app1", config.StickySession{Enabled: true, Secret: "secret"})
+
+	// First response pins the client
+	req := httptest.NewRequest("GET", "/api/app1", nil)
+	assert.Nil(t, stickySession.Backend(req, backends))
+	w := httptest.NewRecorder()
+	stickySession.SetCookie(w, req, backends[1])
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, DefaultStickyCookieName+"-app1", cookies[0].Name)
+
+	req = httptest.NewRequest("GET", "/api/app1", nil)
+	req.AddCookie(cookies[0])
+	assert.Equal(t, backends[1], stickySession.Backend(req, backends))
+
+	// Pinned backend is down
+	assert.Nil(t, stickySession.Backend(req, backends[:1]))
+
+	// Forged cookie
+	req = httptest.NewRequest("GET", "/api/app1", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultStickyCookieName + "-app1", Value: "b"})
+	assert.Nil(t, stickySession.Backend(req, backends))
+}
+
+func TestZoneAwareness(t *testing.T) {
+	local1, local2, local3, remote := newTestBackend("local1"), newTestBackend("local2"), newTestBackend("local3"), newTestBackend("remote")
+	local1.ZoneAws, local2.ZoneAws, local3.ZoneAws, remote.ZoneAws = "sa-east-1a", "sa-east-1a", "sa-east-1a", "sa-east-1b"
+	backends := []*Backend{local1, local2, local3, remote}
+	zoneAwareness := NewZoneAwareness("sa-east-1a", config.ZoneAware{Enabled: true, MinHealthyFraction: 0.5})
+
+	assert.Equal(t, []*Backend{local1, local2, local3}, zoneAwareness.Filter(backends, backends))
+	assert.Equal(t, []*Backend{local1, local2}, zoneAwareness.Filter(backends, []*Backend{local1, local2, remote}))
+	assert.Equal(t, []*Backend{remote}, zoneAwareness.Filter(backends, []*Backend{remote}))
+
+	// One third of local zone is healthy, so one third of requests spills over
+	spilled := 0
+	for i := 0; i < 3000; i++ {
+		if zoneAwareness.Filter(backends, []*Backend{local1, remote})[0] == remote {
+			spilled++
+		}
+	}
+	assert.InDelta(t, 1000, spilled, 150)
+}
+
+func TestPriorityTier(t *testing.T) {
+	primary1, primary2, backup := newTestBackend("primary1"), newTestBackend("primary2"), newTestBackend("backup")
+	backup.Priority = 1
+	backends := []*Backend{primary1, primary2, backup}
+
+	tier, healthy := priorityTier(backends, backends)
+	assert.Equal(t, []*Backend{primary1, primary2}, tier)
+	assert.Equal(t, []*Backend{primary1, primary2}, healthy)
+
+	_, healthy = priorityTier(backends, []*Backend{primary2, backup})
+	assert.Equal(t, []*Backend{primary2}, healthy)
+
+	tier, healthy = priorityTier(backends, []*Backend{backup})
+	assert.Equal(t, []*Backend{backup}, tier)
+	assert.Equal(t, []*Backend{backup}, healthy)
+
+	_, healthy = priorityTier(backends, []*Backend{})
+	assert.Empty(t, healthy)
+}
+
+func TestSlowStart(t *testing.T) {
+	slowStart := NewSlowStart(config.SlowStart{Window: time.Minute, MinWeightFraction: 0.1, Aggression: 2})
+	b := newTestBackend("a")
+
+	b.upSince = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, float64(1), slowStart.Factor(b))
+	assert.Equal(t, []*Backend{b}, slowStart.Warmed([]*Backend{b}))
+
+	// Square root curve with aggression 2
+	b.upSince = time.Now().Add(-15 * time.Second)
+	assert.InDelta(t, 0.5, slowStart.Factor(b), 0.01)
+	assert.Empty(t, slowStart.Warmed([]*Backend{b}))
+
+	b.observeAlive(false)
+	b.observeAlive(true)
+	assert.Equal(t, 0.1, slowStart.Factor(b))
+}
+
+func TestOutlierDetectorConsecutiveFailures(t *testing.T) {
+	backends := []*Backend{newTestBackend("a"), newTestBackend("b")}
+	detector := NewOutlierDetector(config.OutlierDetection{Enabled: true, ConsecutiveGatewayFailure: 2, BaseEjectionTime: time.Minute, MaxEjectionPercent: 50})
+
+	detector.OnResult(backends, backends[0], http.StatusBadGateway, nil)
+	detector.OnResult(backends, backends[0], http.StatusOK, nil)
+	detector.OnResult(backends, backends[0], http.StatusBadGateway, nil)
+	assert.True(t, backends[0].IsAlive())
+
+	detector.OnResult(backends, backends[0], 0, fmt.Errorf("connection refused"))
+	assert.False(t, backends[0].IsAlive())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), backends[0].EjectedUntil, time.Second)
+
+	// Max ejection percent keeps the other backend
+	detector.OnResult(backends, backends[1], http.StatusServiceUnavailable, nil)
+	detector.OnResult(backends, backends[1], http.StatusServiceUnavailable, nil)
+	assert.True(t, backends[1].IsAlive())
+
+	// Next ejection lasts twice
+	backends[0].eject(time.Time{})
+	detector.OnResult(backends, backends[0], http.StatusGatewayTimeout, nil)
+	detector.OnResult(backends, backends[0], http.StatusGatewayTimeout, nil)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), backends[0].EjectedUntil, time.Second)
+}
+
+func TestOutlierDetectorSuccessRate(t *testing.T) {
+	var backends []*Backend
+	for i := 0; i < 5; i++ {
+		backends = append(backends, newTestBackend(fmt.Sprintf("server%d", i)))
+	}
+	detector := NewOutlierDetector(config.OutlierDetection{Enabled: true, SuccessRateRequestVolume: 10, MaxEjectionPercent: 100})
+
+	for i, b := range backends {
+		for j := 0; j < 10; j++ {
+			statusCode := http.StatusOK
+			if i == 0 && j%2 == 0 {
+				statusCode = http.StatusInternalServerError
+			}
+			detector.OnResult(backends, b, statusCode, nil)
+		}
+	}
+	detector.Analyze(backends)
+
+	assert.True(t, backends[0].IsEjected())
+	for _, b := range backends[1:] {
+		assert.False(t, b.IsEjected())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var transitions []string
+	breaker := NewCircuitBreaker(config.CircuitBreaker{Enabled: true, ConsecutiveFailures: 2, OpenTimeout: time.Minute, HalfOpenMaxRequests: 2}, func(from string, to string) {
+		transitions = append(transitions, to)
+	})
+
+	breaker.OnResult(true)
+	assert.True(t, breaker.Allow())
+	breaker.OnResult(true)
+	assert.Equal(t, CircuitOpen, breaker.State)
+	assert.False(t, breaker.Allow())
+
+	// Half open lets only the trials pass
+	breaker.Since = time.Now().Add(-time.Minute)
+	assert.True(t, breaker.Allow())
+	assert.True(t, breaker.Allow())
+	assert.False(t, breaker.Allow())
+	breaker.OnResult(false)
+	breaker.OnResult(false)
+	assert.Equal(t, CircuitClosed, breaker.State)
+
+	// Trials that timed out restart the half open state without a transition
+	breaker.OnResult(true)
+	breaker.OnResult(true)
+	breaker.Since = time.Now().Add(-time.Minute)
+	assert.True(t, breaker.Allow())
+	breaker.Since = time.Now().Add(-time.Minute)
+	assert.True(t, breaker.Ready())
+	assert.Equal(t, []string{CircuitOpen, CircuitHalfOpen, CircuitClosed, CircuitOpen, CircuitHalfOpen}, transitions)
+
+	// Persisted state is restored only when it's newer
+	assert.False(t, breaker.restore(circuitBreakerState{State: CircuitOpen, Since: time.Now().Add(-time.Hour)}))
+	assert.Equal(t, CircuitHalfOpen, breaker.State)
+	assert.True(t, breaker.restore(circuitBreakerState{State: CircuitOpen, Since: time.Now()}))
+	assert.Equal(t, CircuitOpen, breaker.State)
+	assert.False(t, breaker.Ready())
+	assert.Len(t, transitions, 5)
+}
+
+func TestCircuitBreakerFailureRatio(t *testing.T) {
+	breaker := NewCircuitBreaker(config.CircuitBreaker{Enabled: true, ConsecutiveFailures: 100, FailureRatio: 0.5, MinRequests: 4, Window: time.Minute}, nil)
+
+	breaker.OnResult(true)
+	breaker.OnResult(false)
+	breaker.OnResult(true)
+	assert.Equal(t, CircuitClosed, breaker.State)
+	breaker.OnResult(false)
+	breaker.OnResult(true)
+	assert.Equal(t, CircuitOpen, breaker.State)
+	assert.Contains(t, breaker.Reason, "failure ratio")
+
+	// Trial request fails
+	breaker.Since = time.Now().Add(-time.Hour)
+	assert.True(t, breaker.Allow())
+	breaker.OnResult(true)
+	assert.Equal(t, CircuitOpen, breaker.State)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := NewRetryPolicy(config.Retry{MaxAttempts: 3, BackoffBase: 10 * time.Millisecond, BackoffMax: 50 * time.Millisecond, RetriableStatusCodes: []int{http.StatusServiceUnavailable}})
+
+	assert.Equal(t, 3, policy.Attempts(httptest.NewRequest("GET", "/api/app1", nil)))
+	assert.Equal(t, 1, policy.Attempts(httptest.NewRequest("POST", "/api/app1", nil)))
+
+	assert.True(t, policy.ShouldRetry(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	assert.False(t, policy.ShouldRetry(&http.Response{StatusCode: http.StatusInternalServerError}, nil))
+	assert.True(t, policy.ShouldRetry(nil, &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}))
+	assert.False(t, policy.ShouldRetry(nil, &net.OpError{Op: "read", Err: fmt.Errorf("connection reset")}))
+
+	assert.GreaterOrEqual(t, int64(policy.Backoff(1)), int64(5*time.Millisecond))
+	assert.LessOrEqual(t, int64(policy.Backoff(1)), int64(10*time.Millisecond))
+	assert.LessOrEqual(t, int64(policy.Backoff(5)), int64(50*time.Millisecond))
+}
+
+func TestRetryPolicyRequestBody(t *testing.T) {
+	policy := NewRetryPolicy(config.Retry{MaxAttempts: 3, RetryNonIdempotent: true, MaxBufferedBodyBytes: 8})
+
+	req := httptest.NewRequest("POST", "/api/app1", strings.NewReader("payload"))
+	body, attempts, err := policy.RequestBody(req, policy.Attempts(req))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	for i := 0; i < attempts; i++ {
+		replayed, _ := ioutil.ReadAll(body())
+		assert.Equal(t, "payload", string(replayed))
+	}
+
+	// Larger than buffer isn't retried
+	req = httptest.NewRequest("POST", "/api/app1", strings.NewReader("large payload"))
+	body, attempts, err = policy.RequestBody(req, policy.Attempts(req))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+	streamed, _ := ioutil.ReadAll(body())
+	assert.Equal(t, "large payload", string(streamed))
+
+	// Streams without length aren't read before the first attempt
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	req = httptest.NewRequest("POST", "/api/app1", reader)
+	req.ContentLength = -1
+	body, attempts, err = policy.RequestBody(req, policy.Attempts(req))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, reader, body())
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(config.RetryBudget{Enabled: true, Percent: 50, MinRetriesPerSecond: 1, TTL: 2 * time.Second})
+
+	// Floor of min retries per second during the ttl
+	assert.True(t, budget.TryRetry())
+	assert.True(t, budget.TryRetry())
+	assert.False(t, budget.TryRetry())
+
+	// Half of the requests
+	for i := 0; i < 10; i++ {
+		budget.OnRequest()
+	}
+	assert.True(t, budget.TryRetry())
+	assert.True(t, budget.TryRetry())
+	assert.True(t, budget.TryRetry())
+	assert.False(t, budget.TryRetry())
+}
+
+func TestLatencyWindow(t *testing.T) {
+	window := NewLatencyWindow(100)
+	_, ok := window.Percentile(90)
+	assert.False(t, ok)
+
+	for i := 1; i <= 200; i++ {
+		window.Observe(time.Duration(i) * time.Millisecond)
+	}
+	p50, ok := window.Percentile(50)
+	assert.True(t, ok)
+	assert.Equal(t, 150*time.Millisecond, p50)
+	p99, _ := window.Percentile(99)
+	assert.Equal(t, 199*time.Millisecond, p99)
+}
+
+func TestHedgingPolicy(t *testing.T) {
+	_, err := NewHedgingPolicy(config.Hedging{Enabled: true, DelayPercentile: 150})
+	assert.NotNil(t, err)
+	policy, err := NewHedgingPolicy(config.Hedging{Enabled: true, Delay: 50 * time.Millisecond, DelayPercentile: 95})
+	assert.Nil(t, err)
+
+	assert.True(t, policy.Applies(httptest.NewRequest("GET", "/api/app1", nil)))
+	assert.False(t, policy.Applies(httptest.NewRequest("POST", "/api/app1", nil)))
+	assert.False(t, policy.Applies(httptest.NewRequest("GET", "/api/app1", strings.NewReader("body"))))
+
+	// Fixed delay until there are enough samples
+	assert.Equal(t, 50*time.Millisecond, policy.Delay())
+	for i := 1; i <= 100; i++ {
+		policy.latencies.Observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 95*time.Millisecond, policy.Delay())
+}
+
+// useMemoryHealthCells keeps the backend states in memory during the test, instead of the health cells bucket
+func useMemoryHealthCells(t *testing.T) {
+	cells := make(map[string]string)
+	var mux sync.Mutex
+	getHealthCell = func(bucket string, key string) (string, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		value, ok := cells[bucket+"/"+key]
+		if !ok {
+			return "", errApp.NewNotFoundError(key)
+		}
+		return value, nil
+	}
+	putHealthCell = func(bucket string, key string, value string) error {
+		mux.Lock()
+		defer mux.Unlock()
+		cells[bucket+"/"+key] = value
+		return nil
+	}
+	t.Cleanup(func() {
+		getHealthCell = repository.GetStringObject
+		putHealthCell = repository.PutStringObject
+	})
+}
+
+// newTestServerPool returns a pool of the service with a backend by upstream
+func newTestServerPool(t *testing.T, service config.Service, upstreams ...*httptest.Server) *ServerPool {
+	useMemoryHealthCells(t)
+	service.ServicePrefix = "app1"
+	pool, err := NewServerPool(service)
+	assert.Nil(t, err)
+	for _, upstream := range upstreams {
+		upstreamUrl, _ := url.Parse(upstream.URL)
+		pool.AddBackend(newTestBackend(upstreamUrl.Host))
+	}
+	return pool
+}
+
+// handleTestRequest sends the request to the pool, like the router does for /api/app1{path}
+func handleTestRequest(pool *ServerPool, method string, path string) (*httptest.ResponseRecorder, error) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(method, "/api/app1"+path, nil)
+	err := pool.HandleRequest(c, path, method, c.Request.Header)
+	return recorder, err
+}
+
+func TestHandleRequestRetry(t *testing.T) {
+	var failures int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failures, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	defer healthy.Close()
+
+	// Failed attempts are retried on the other backend
+	pool := newTestServerPool(t, config.Service{Retry: config.Retry{MaxAttempts: 2, BackoffBase: time.Millisecond, RetriableStatusCodes: []int{http.StatusServiceUnavailable}}}, failing, healthy)
+	for i := 0; i < 4; i++ {
+		recorder, err := handleTestRequest(pool, "GET", "/users")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "ok /users", recorder.Body.String())
+	}
+	assert.True(t, atomic.LoadInt32(&failures) > 0)
+
+	// Without budget, the last result is answered and flagged
+	pool = newTestServerPool(t, config.Service{Retry: config.Retry{MaxAttempts: 2, BackoffBase: time.Millisecond, RetriableStatusCodes: []int{http.StatusServiceUnavailable}}, RetryBudget: config.RetryBudget{Enabled: true}}, failing, failing)
+	for pool.retryBudget.TryRetry() {
+	}
+	recorder, err := handleTestRequest(pool, "GET", "/users")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "true", recorder.Header().Get(constant.RetryBudgetHeaderName))
+
+	// The backoff ends with the request
+	pool = newTestServerPool(t, config.Service{Retry: config.Retry{MaxAttempts: 2, BackoffBase: time.Minute, BackoffMax: time.Minute, RetriableStatusCodes: []int{http.StatusServiceUnavailable}}, Timeouts: config.Timeouts{Request: 100 * time.Millisecond}}, failing, healthy)
+	start := time.Now()
+	timedOut := 0
+	for i := 0; i < 2; i++ {
+		if _, err := handleTestRequest(pool, "GET", "/users"); err != nil {
+			assert.IsType(t, errApp.TimeoutError{}, err)
+			timedOut++
+		}
+	}
+	assert.Equal(t, 1, timedOut)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestHandleRequestHedge(t *testing.T) {
+	canceled := make(chan struct{}, 2)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	// The hedge to the fast backend wins and the slow request is canceled
+	pool := newTestServerPool(t, config.Service{Hedging: config.Hedging{Enabled: true, Delay: 20 * time.Millisecond, MinHedgesPerSecond: 10}}, slow, fast)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		recorder, err := handleTestRequest(pool, "GET", "/users")
+		assert.Nil(t, err)
+		assert.Equal(t, "fast", recorder.Body.String())
+	}
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow request wasn't canceled")
+	}
+
+	// A failure waits the other request
+	aborted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		panic(http.ErrAbortHandler)
+	}))
+	defer aborted.Close()
+	late := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("late"))
+	}))
+	defer late.Close()
+	pool = newTestServerPool(t, config.Service{Hedging: config.Hedging{Enabled: true, Delay: 20 * time.Millisecond, MinHedgesPerSecond: 10}}, aborted, late)
+	for i := 0; i < 2; i++ {
+		recorder, err := handleTestRequest(pool, "GET", "/users")
+		assert.Nil(t, err)
+		assert.Equal(t, "late", recorder.Body.String())
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	timeouts := NewTimeouts(config.Timeouts{Request: time.Second, ResponseHeader: 50 * time.Millisecond})
+	assert.Equal(t, DefaultConnectTimeout, timeouts.Connect)
+	assert.Equal(t, DefaultHealthCheckTimeout, timeouts.HealthCheck)
+
+	// The client deadline is used when it's shorter than the timeout of the pool
+	r := httptest.NewRequest("GET", "/api/app1", nil)
+	r.Header.Set(constant.DeadlineHeaderName, "200")
+	ctx := newRequestDeadline(r.Context(), timeouts.RequestTimeout(r))
+	defer ctx.cancel()
+	header := http.Header{}
+	setDeadlineHeader(ctx, header)
+	remaining, err := strconv.Atoi(header.Get(constant.DeadlineHeaderName))
+	assert.Nil(t, err)
+	assert.True(t, remaining > 0 && remaining <= 200)
+
+	// A backend that doesn't answer within the response header timeout fails
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	connections, _ := NewConnectionPool("app1", config.Transport{}, timeouts)
+	_, err = connections.Client().Get(slow.URL)
+	assert.NotNil(t, err)
+	assert.True(t, isTimeout(err))
+}
+
+func TestWriteResponseStreaming(t *testing.T) {
+	payload := strings.Repeat("x", 3*StreamBufferSize+10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(payload))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	resp, err := http.Get(upstream.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/api/app1", nil)
+	pool, _ := NewServerPool(config.Service{ServicePrefix: "app1"})
+	assert.Nil(t, pool.writeResponse(&proxyRequest{c: c}, newTestBackend("a"), resp))
+
+	result := recorder.Result()
+	body, _ := ioutil.ReadAll(result.Body)
+	assert.Equal(t, http.StatusCreated, result.StatusCode)
+	assert.Equal(t, payload, string(body))
+	assert.Equal(t, []string{"a", "b"}, result.Header.Values("X-Multi"))
+	assert.Equal(t, "abc", result.Trailer.Get("X-Checksum"))
+	assert.True(t, recorder.Flushed)
+}
+
+func TestHeaders(t *testing.T) {
+	disabled := HeadersDisabledInRedirection(nil)
+	assert.True(t, disabled("accept-encoding"))
+	assert.False(t, disabled("Authorization"))
+	disabled = HeadersDisabledInRedirection([]string{"x-internal"})
+	assert.True(t, disabled("X-Internal"))
+	assert.False(t, disabled("Accept-Encoding"))
+
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, X-Session")
+	header.Set("X-Session", "abc")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Te", "trailers")
+	header.Add("Cache-Control", "no-cache")
+	header.Add("Cache-Control", "no-store")
+	removeHopHeaders(header)
+	assert.Empty(t, header.Get("Connection"))
+	assert.Empty(t, header.Get("X-Session"))
+	assert.Empty(t, header.Get("Keep-Alive"))
+	assert.Equal(t, "trailers", header.Get("Te"))
+	assert.Equal(t, []string{"no-cache", "no-store"}, header.Values("Cache-Control"))
+
+	r := httptest.NewRequest("GET", "/api/app1", nil)
+	r.RemoteAddr = "[2001:db8::1]:5000"
+	r.Host = "router.local"
+	header = http.Header{}
+	header.Set("X-Forwarded-For", "10.0.0.1")
+	addForwardedHeaders(header, r, "router")
+	assert.Equal(t, "10.0.0.1, 2001:db8::1", header.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "router.local", header.Get("X-Forwarded-Host"))
+	assert.Equal(t, `for="[2001:db8::1]";host=router.local;proto=http`, header.Get("Forwarded"))
+	assert.Equal(t, "1.1 router", header.Get("Via"))
+}
+
+func TestConnectionPool(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	connections, err := NewConnectionPool("app1", config.Transport{MaxIdleConnsPerHost: 2}, NewTimeouts(config.Timeouts{}))
+	assert.Nil(t, err)
+	client := connections.Client()
+
+	resp, err := client.Get(upstream.URL)
+	assert.Nil(t, err)
+	open, inUse := connections.Stats()
+	assert.Equal(t, 1, open)
+	assert.Equal(t, 1, inUse)
+
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	open, inUse = connections.Stats()
+	assert.Equal(t, 1, open)
+	assert.Equal(t, 0, inUse)
+
+	connections.closeIdleConnections()
+	open, _ = connections.Stats()
+	assert.Equal(t, 0, open)
+
+	// Connections older than the max lifetime are closed when their response ends
+	connections, err = NewConnectionPool("app1", config.Transport{MaxConnLifetime: 50 * time.Millisecond}, NewTimeouts(config.Timeouts{}))
+	assert.Nil(t, err)
+	resp, err = connections.Client().Get(upstream.URL)
+	assert.Nil(t, err)
+	time.Sleep(60 * time.Millisecond)
+	open, _ = connections.Stats()
+	assert.Equal(t, 1, open)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	open, inUse = connections.Stats()
+	assert.Equal(t, 0, open)
+	assert.Equal(t, 0, inUse)
+
+	_, err = NewConnectionPool("app1", config.Transport{TLS: config.TLS{MinVersion: "9.9"}}, NewTimeouts(config.Timeouts{}))
+	assert.NotNil(t, err)
+}
+
+func TestTunnel(t *testing.T) {
+	header := http.Header{}
+	assert.Empty(t, upgradeType(header))
+	header.Set("Connection", "keep-alive, Upgrade")
+	header.Set("Upgrade", "websocket")
+	assert.Equal(t, "websocket", upgradeType(header))
+
+	// Bytes are copied both ways until the tunnel is idle
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	tun := newTunnel(client, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)), backend, false)
+	reason := make(chan string)
+	go func() { reason <- tun.run(100*time.Millisecond, time.Minute) }()
+
+	go clientPeer.Write([]byte("ping"))
+	buffer := make([]byte, 4)
+	_, err := io.ReadFull(backendPeer, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buffer))
+
+	go backendPeer.Write([]byte("pong"))
+	_, err = io.ReadFull(clientPeer, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(buffer))
+	assert.Equal(t, "idle timeout", <-reason)
+
+	// Draining closes the tunnels that don't finish in time
+	client, _ = net.Pipe()
+	backend, _ = net.Pipe()
+	tun = newTunnel(client, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)), backend, false)
+	registry := &TunnelRegistry{tunnels: make(map[*tunnel]bool)}
+	registry.add(tun)
+	go func() { reason <- tun.run(time.Minute, time.Minute) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	registry.Drain(ctx)
+	assert.True(t, registry.Draining())
+	assert.Equal(t, "router shutdown", <-reason)
+
+	// WebSocket sides get the going away close frame, masked for the backend
+	client, clientPeer = net.Pipe()
+	backend, backendPeer = net.Pipe()
+	tun = newTunnel(client, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)), backend, true)
+	registry = &TunnelRegistry{tunnels: make(map[*tunnel]bool)}
+	registry.add(tun)
+	go func() { reason <- tun.run(time.Minute, time.Minute) }()
+	frames := make(chan []byte, 2)
+	go func() {
+		frame := make([]byte, 4)
+		io.ReadFull(clientPeer, frame)
+		frames <- frame
+	}()
+	go func() {
+		frame := make([]byte, 8)
+		io.ReadFull(backendPeer, frame)
+		for i := 6; i < 8; i++ {
+			frame[i] ^= frame[2+(i-6)%4]
+		}
+		frames <- append(frame[:2], frame[6:]...)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	registry.Drain(ctx)
+	assert.Equal(t, "router shutdown", <-reason)
+	first, second := <-frames, <-frames
+	assert.ElementsMatch(t, [][]byte{{0x88, 0x02, 0x03, 0xe9}, {0x88, 0x82, 0x03, 0xe9}}, [][]byte{first, second})
+
+	// Close frames are only sent between frames
+	fw := &frameWriter{w: ioutil.Discard, track: true}
+	fw.Write([]byte{0x82, 0x7e, 0x01})
+	assert.NotEmpty(t, fw.header)
+	fw.Write([]byte{0x00})
+	assert.Equal(t, uint64(256), fw.remaining)
+	fw.Write(make([]byte, 256))
+	assert.Empty(t, fw.header)
+	assert.Equal(t, uint64(0), fw.remaining)
+}
+
+func TestConnectionPoolProtocols(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	for protocol, expected := range map[string]string{ProtocolAuto: "HTTP/1.1", ProtocolHTTP1: "HTTP/1.1", ProtocolH2C: "HTTP/2.0"} {
+		connections, err := NewConnectionPool("app1", config.Transport{Protocol: protocol}, NewTimeouts(config.Timeouts{}))
+		assert.Nil(t, err)
+		resp, err := connections.Client().Get(upstream.URL)
+		assert.Nil(t, err)
+		_, inUse := connections.Stats()
+		assert.Equal(t, 1, inUse, protocol)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, expected, string(body), protocol)
+		_, inUse = connections.Stats()
+		assert.Equal(t, 0, inUse, protocol)
+
+		// gRPC calls are HTTP/2 whatever the protocol of the pool
+		resp, err = connections.GrpcClient().Get(upstream.URL)
+		assert.Nil(t, err)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", string(body), protocol)
+		connections.closeIdleConnections()
+	}
+
+	// The response header timeout also applies to HTTP/2 with prior knowledge
+	slow := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}), &http2.Server{}))
+	defer slow.Close()
+	connections, err := NewConnectionPool("app1", config.Transport{Protocol: ProtocolH2C}, NewTimeouts(config.Timeouts{ResponseHeader: 50 * time.Millisecond}))
+	assert.Nil(t, err)
+	_, err = connections.Client().Get(slow.URL)
+	assert.True(t, isTimeout(err))
+	_, inUse := connections.Stats()
+	assert.Equal(t, 0, inUse)
+
+	_, err = NewConnectionPool("app1", config.Transport{Protocol: "spdy"}, NewTimeouts(config.Timeouts{}))
+	assert.NotNil(t, err)
+}
+
+func TestGrpc(t *testing.T) {
+	service, ok := GrpcServiceName("/helloworld.Greeter/SayHello")
+	assert.True(t, ok)
+	assert.Equal(t, "helloworld.Greeter", service)
+	_, ok = GrpcServiceName("/api/app1/users")
+	assert.False(t, ok)
+
+	grpcServices := []config.GrpcService{{Service: "helloworld.Greeter", ServicePrefix: "app1"}, {Service: "routeguide.*", ServicePrefix: "app2"}}
+	prefix, _ := GrpcServicePrefix(grpcServices, "helloworld.Greeter")
+	assert.Equal(t, "app1", prefix)
+	prefix, _ = GrpcServicePrefix(grpcServices, "routeguide.RouteGuide")
+	assert.Equal(t, "app2", prefix)
+	_, ok = GrpcServicePrefix(grpcServices, "helloworld.Other")
+	assert.False(t, ok)
+
+	timeout, ok := parseGrpcTimeout("250m")
+	assert.True(t, ok)
+	assert.Equal(t, 250*time.Millisecond, timeout)
+	_, ok = parseGrpcTimeout("10x")
+	assert.False(t, ok)
+
+	// gRPC calls have the deadline of the client instead of the pool timeout
+	timeouts := NewTimeouts(config.Timeouts{Request: time.Second})
+	call := httptest.NewRequest("POST", "/helloworld.Greeter/SayHello", nil)
+	call.Header.Set("Content-Type", "application/grpc")
+	assert.Equal(t, time.Duration(0), timeouts.RequestTimeout(call))
+	call.Header.Set(GrpcTimeoutHeaderName, "2M")
+	assert.Equal(t, 2*time.Minute, timeouts.RequestTimeout(call))
+
+	// gRPC calls aren't retried, their bodies are streamed
+	rp := NewRetryPolicy(config.Retry{MaxAttempts: 3})
+	assert.Equal(t, 1, rp.Attempts(call))
+}
+
+func TestWriteResponseGrpcStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "14")
+	}))
+	defer upstream.Close()
+
+	resp, err := http.Post(upstream.URL, "application/grpc", nil)
+	assert.Nil(t, err)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/helloworld.Greeter/SayHello", nil)
+	pool, _ := NewServerPool(config.Service{ServicePrefix: "app1"})
+	backend := newTestBackend("a")
+	assert.Nil(t, pool.writeResponse(&proxyRequest{c: c}, backend, resp))
+
+	assert.Equal(t, "14", recorder.Result().Trailer.Get(GrpcStatusHeaderName))
+	assert.Equal(t, uint32(1), backend.CountsRequests.TotalFailures)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	// The overall timeout ends the request with deadline exceeded, for the derived contexts too
+	d := newRequestDeadline(context.Background(), 20*time.Millisecond)
+	child, cancel := context.WithCancel(d)
+	defer cancel()
+	_, ok := d.Deadline()
+	assert.True(t, ok)
+	<-child.Done()
+	assert.Equal(t, context.DeadlineExceeded, d.Err())
+	assert.Equal(t, context.DeadlineExceeded, child.Err())
+
+	// Streams stop the overall timeout and end when idle
+	d = newRequestDeadline(context.Background(), 20*time.Millisecond)
+	d.stream(60 * time.Millisecond)
+	_, ok = d.Deadline()
+	assert.False(t, ok)
+	time.Sleep(40 * time.Millisecond)
+	d.touch()
+	time.Sleep(40 * time.Millisecond)
+	assert.Nil(t, d.Err())
+	<-d.Done()
+	assert.Equal(t, context.DeadlineExceeded, d.Err())
+
+	// Shutdown closes the open streams and the new ones
+	registry := &StreamRegistry{streams: make(map[*requestDeadline]bool)}
+	d = newRequestDeadline(context.Background(), 0)
+	registry.add(d)
+	registry.Close()
+	assert.Equal(t, context.Canceled, d.Err())
+	d = newRequestDeadline(context.Background(), 0)
+	registry.add(d)
+	assert.Equal(t, context.Canceled, d.Err())
+}
+
+func TestWriteResponseEventStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	pool, _ := NewServerPool(config.Service{ServicePrefix: "app1", Streaming: config.Streaming{IdleTimeout: 50 * time.Millisecond}})
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/api/app1/events", nil)
+	deadline := newRequestDeadline(context.Background(), 10*time.Millisecond)
+	defer deadline.cancel()
+	req, _ := http.NewRequestWithContext(deadline, "GET", upstream.URL, nil)
+	resp, err := pool.streamClient.Do(req)
+	assert.Nil(t, err)
+
+	// The stream outlives the overall timeout and ends after the idle timeout
+	start := time.Now()
+	assert.Nil(t, pool.writeResponse(&proxyRequest{c: c, pathUri: "/events", deadline: deadline}, newTestBackend("a"), resp))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, "data: one\n\n", recorder.Body.String())
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, context.DeadlineExceeded, deadline.Err())
+}
+
+func TestCors(t *testing.T) {
+	cors, err := NewCorsPolicy(config.CORS{
+		Enabled:          true,
+		AllowedOrigins:   []string{"https://*.example.com", "http://localhost:8080"},
+		AllowedHeaders:   []string{"Content-Type"},
+		ExposedHeaders:   []string{"x-trace-id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	assert.Nil(t, err)
+	assert.True(t, cors.AllowedOrigin("https://app.example.com"))
+	assert.True(t, cors.AllowedOrigin("HTTP://localhost:8080"))
+	assert.False(t, cors.AllowedOrigin("https://example.com"))
+	assert.False(t, cors.AllowedOrigin("https://app.example.com.evil.io"))
+
+	// Allowed preflight
+	r := httptest.NewRequest("OPTIONS", "/api/app1/users", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	r.Header.Set("Access-Control-Request-Headers", "content-type")
+	assert.True(t, IsPreflight(r))
+	w := httptest.NewRecorder()
+	cors.HandlePreflight(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, HEAD, POST, PUT, PATCH, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	// Headers not allowed
+	r.Header.Set("Access-Control-Request-Headers", "x-internal")
+	w = httptest.NewRecorder()
+	cors.HandlePreflight(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Responses
+	r = httptest.NewRequest("GET", "/api/app1/users", nil)
+	r.Header.Set("Origin", "http://localhost:8080")
+	header := http.Header{}
+	cors.SetHeaders(header, r)
+	assert.Equal(t, "http://localhost:8080", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "x-trace-id", header.Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", header.Get("Vary"))
+	r.Header.Set("Origin", "https://evil.io")
+	header = http.Header{}
+	cors.SetHeaders(header, r)
+	assert.Empty(t, header.Get("Access-Control-Allow-Origin"))
+
+	// All origins only without credentials
+	_, err = NewCorsPolicy(config.CORS{Enabled: true, AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	assert.NotNil(t, err)
+	cors, err = NewCorsPolicy(config.CORS{Enabled: true, AllowedOrigins: []string{"*"}})
+	assert.Nil(t, err)
+	header = http.Header{}
+	cors.SetHeaders(header, r)
+	assert.Equal(t, "*", header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestRewrite(t *testing.T) {
+	path, err := NormalizePath("//app1/./orders//app1/")
+	assert.Nil(t, err)
+	assert.Equal(t, "/app1/orders/app1/", path)
+	path, _ = NormalizePath("")
+	assert.Equal(t, "/", path)
+	_, err = NormalizePath("/app1/../admin")
+	assert.NotNil(t, err)
+
+	_, err = NewRewriter(config.Rewrite{Rules: []config.RewriteRule{{Type: "unknown"}}})
+	assert.NotNil(t, err)
+	_, err = NewRewriter(config.Rewrite{Rules: []config.RewriteRule{{Type: RewriteRegex, Match: "("}}})
+	assert.NotNil(t, err)
+
+	rewriter, err := NewRewriter(config.Rewrite{
+		Rules: []config.RewriteRule{
+			{Type: RewriteStripPrefix, Match: "/public"},
+			{Type: RewriteReplacePrefix, Match: "/legacy/", Replacement: "/v1"},
+			{Type: RewriteRegex, Match: "^/users/([0-9]+)/profile$", Replacement: "/profiles/$1"},
+		},
+		BasePath: "api/",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/api/orders", rewriter.Rewrite("/public/orders"))
+	assert.Equal(t, "/api/", rewriter.Rewrite("/public"))
+	assert.Equal(t, "/api/publicity", rewriter.Rewrite("/publicity"))
+	assert.Equal(t, "/api/v1/orders", rewriter.Rewrite("/legacy/orders"))
+	assert.Equal(t, "/api/profiles/42", rewriter.Rewrite("/users/42/profile"))
+
+	// Query string is kept on the rewritten path
+	pool, _ := NewServerPool(config.Service{ServicePrefix: "app1", Rewrite: config.Rewrite{BasePath: "/v2"}})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/app1/orders/app1?status=open&q=a%20b", nil)
+	pr := &proxyRequest{c: c, pathUri: "/orders/app1", upstreamPath: pool.rewriter.Rewrite("/orders/app1"), method: "GET", body: func() io.Reader { return nil }}
+	req, err := pool.newUpstreamRequest(context.Background(), pr, newTestBackend("backend:8080"))
+	assert.Nil(t, err)
+	assert.Equal(t, "http://backend:8080/v2/orders/app1?status=open&q=a%20b", req.URL.String())
+}
+
+func TestRouteTable(t *testing.T) {
+	_, err := NewRouteTable([]config.Route{{Path: config.RoutePath{Type: "xpto"}, ServicePrefix: "app1"}})
+	assert.NotNil(t, err)
+	_, err = NewRouteTable([]config.Route{{Headers: []config.RouteValue{{Name: "x", Regex: "("}}, ServicePrefix: "app1"}})
+	assert.NotNil(t, err)
+	_, err = NewRouteTable([]config.Route{{Hosts: []string{"api.example.com"}}})
+	assert.NotNil(t, err)
+
+	routeTable, err := NewRouteTable([]config.Route{
+		{Hosts: []string{"admin.example.com"}, ServicePrefix: "admin"},
+		{Hosts: []string{"*.example.com"}, Path: config.RoutePath{Type: RoutePathPrefix, Value: "/orders"},
+			Headers: []config.RouteValue{{Name: "x-api-version", Value: "2"}}, ServicePrefix: "orders-v2"},
+		{Path: config.RoutePath{Type: RoutePathExact, Value: "/status"}, Methods: []string{"get", "head"}, ServicePrefix: "status"},
+		{Path: config.RoutePath{Type: RoutePathRegex, Value: "^/users/[0-9]+$"}, Query: []config.RouteValue{{Name: "beta"}}, ServicePrefix: "users-beta"},
+		{Hosts: []string{"api.example.com"}, ServicePrefix: "api"},
+	})
+	assert.Nil(t, err)
+	assert.False(t, routeTable.Empty())
+
+	match := func(method string, target string, header http.Header) string {
+		r := httptest.NewRequest(method, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		path, _ := NormalizePath(r.URL.Path)
+		servicePrefix, _ := routeTable.Match(r, path)
+		return servicePrefix
+	}
+	assert.Equal(t, "admin", match("GET", "http://ADMIN.example.com:8080/users", nil))
+	assert.Equal(t, "orders-v2", match("GET", "http://api.example.com/orders/1", http.Header{"X-Api-Version": {"2"}}))
+	assert.Equal(t, "api", match("GET", "http://api.example.com/orders/1", http.Header{"X-Api-Version": {"1"}}))
+	assert.Equal(t, "api", match("GET", "http://api.example.com/ordersx", http.Header{"X-Api-Version": {"2"}}))
+	assert.Equal(t, "status", match("HEAD", "http://other.com/status", nil))
+	assert.Equal(t, "", match("POST", "http://other.com/status", nil))
+	assert.Equal(t, "users-beta", match("GET", "http://other.com/users/42?beta", nil))
+	assert.Equal(t, "", match("GET", "http://other.com/users/42", nil))
+
+	// The pool gets the path after /api/{prefix} of the route, like the routes by prefix, or the whole path
+	assert.Equal(t, "/users/1", ServicePath("app1", "/api/app1/users/1"))
+	assert.Equal(t, "", ServicePath("app1", "/api/app1"))
+	assert.Equal(t, "/api/app10/users", ServicePath("app1", "/api/app10/users"))
+	assert.Equal(t, "/api/app2/x", ServicePath("app1", "/api/app2/x"))
+	assert.Equal(t, "/orders/1", ServicePath("app1", "/orders/1"))
+}
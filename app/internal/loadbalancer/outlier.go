@@ -0,0 +1,186 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const (
+	DefaultOutlierInterval                  = 10 * time.Second
+	DefaultOutlierConsecutive5xx            = 5
+	DefaultOutlierConsecutiveGatewayFailure = 5
+	DefaultOutlierSuccessRateMinimumHosts   = 5
+	DefaultOutlierSuccessRateRequestVolume  = 100
+	DefaultOutlierSuccessRateStdevFactor    = 1.9
+	DefaultOutlierBaseEjectionTime          = 30 * time.Second
+	DefaultOutlierMaxEjectionTime           = 300 * time.Second
+	DefaultOutlierMaxEjectionPercent        = 10
+)
+
+// outlierStats holds the results of the requests to a backend
+type outlierStats struct {
+	consecutive5xx            uint32
+	consecutiveGatewayFailure uint32
+	requests                  uint32
+	successes                 uint32
+	ejections                 uint32
+}
+
+// OutlierDetector ejects the backends that fail the real requests, like envoy does. A backend is ejected after
+// consecutive 5xx or gateway failures, or when its success rate deviates from the mean of the pool. Each new ejection
+// lasts twice the previous one, up to the max ejection time, and no more than max ejection percent of backends are ejected.
+type OutlierDetector struct {
+	config config.OutlierDetection
+	stats  map[*Backend]*outlierStats
+	mux    sync.Mutex
+}
+
+func NewOutlierDetector(outlierConfig config.OutlierDetection) *OutlierDetector {
+	if outlierConfig.Interval <= 0 {
+		outlierConfig.Interval = DefaultOutlierInterval
+	}
+	if outlierConfig.Consecutive5xx == 0 {
+		outlierConfig.Consecutive5xx = DefaultOutlierConsecutive5xx
+	}
+	if outlierConfig.ConsecutiveGatewayFailure == 0 {
+		outlierConfig.ConsecutiveGatewayFailure = DefaultOutlierConsecutiveGatewayFailure
+	}
+	if outlierConfig.SuccessRateMinimumHosts <= 0 {
+		outlierConfig.SuccessRateMinimumHosts = DefaultOutlierSuccessRateMinimumHosts
+	}
+	if outlierConfig.SuccessRateRequestVolume == 0 {
+		outlierConfig.SuccessRateRequestVolume = DefaultOutlierSuccessRateRequestVolume
+	}
+	if outlierConfig.SuccessRateStdevFactor <= 0 {
+		outlierConfig.SuccessRateStdevFactor = DefaultOutlierSuccessRateStdevFactor
+	}
+	if outlierConfig.BaseEjectionTime <= 0 {
+		outlierConfig.BaseEjectionTime = DefaultOutlierBaseEjectionTime
+	}
+	if outlierConfig.MaxEjectionTime <= 0 {
+		outlierConfig.MaxEjectionTime = DefaultOutlierMaxEjectionTime
+	}
+	if outlierConfig.MaxEjectionPercent <= 0 {
+		outlierConfig.MaxEjectionPercent = DefaultOutlierMaxEjectionPercent
+	}
+	return &OutlierDetector{config: outlierConfig, stats: make(map[*Backend]*outlierStats)}
+}
+
+func (od *OutlierDetector) statsOf(b *Backend) *outlierStats {
+	stats, found := od.stats[b]
+	if !found {
+		stats = &outlierStats{}
+		od.stats[b] = stats
+	}
+	return stats
+}
+
+// OnResult records the result of a request to the backend and ejects it after consecutive failures
+func (od *OutlierDetector) OnResult(backends []*Backend, b *Backend, statusCode int, err error) {
+	od.mux.Lock()
+	defer od.mux.Unlock()
+
+	stats := od.statsOf(b)
+	stats.requests++
+	switch {
+	case isGatewayFailure(statusCode, err):
+		stats.consecutive5xx++
+		stats.consecutiveGatewayFailure++
+	case statusCode >= http.StatusInternalServerError:
+		stats.consecutive5xx++
+		stats.consecutiveGatewayFailure = 0
+	default:
+		stats.successes++
+		stats.consecutive5xx = 0
+		stats.consecutiveGatewayFailure = 0
+	}
+
+	if stats.consecutive5xx >= od.config.Consecutive5xx || stats.consecutiveGatewayFailure >= od.config.ConsecutiveGatewayFailure {
+		od.eject(backends, b)
+	}
+}
+
+// Analyze ejects the backends with success rate below the mean minus stdev factor of standard deviations.
+// It runs every interval, and the backends not ejected in the interval have the ejection time reduced.
+func (od *OutlierDetector) Analyze(backends []*Backend) {
+	od.mux.Lock()
+	defer od.mux.Unlock()
+
+	var candidates []*Backend
+	var rates []float64
+	for _, b := range backends {
+		stats := od.statsOf(b)
+		if stats.requests >= od.config.SuccessRateRequestVolume && !b.IsEjected() {
+			candidates = append(candidates, b)
+			rates = append(rates, float64(stats.successes)/float64(stats.requests))
+		}
+	}
+
+	if len(candidates) >= od.config.SuccessRateMinimumHosts {
+		var mean, variance float64
+		for _, rate := range rates {
+			mean += rate
+		}
+		mean /= float64(len(rates))
+		for _, rate := range rates {
+			variance += (rate - mean) * (rate - mean)
+		}
+		stdev := math.Sqrt(variance / float64(len(rates)))
+		threshold := mean - od.config.SuccessRateStdevFactor*stdev
+		for i, b := range candidates {
+			if rates[i] < threshold {
+				od.eject(backends, b)
+			}
+		}
+	}
+
+	for _, b := range backends {
+		stats := od.statsOf(b)
+		if !b.IsEjected() && stats.ejections > 0 && stats.requests > 0 && stats.successes == stats.requests {
+			stats.ejections--
+		}
+		stats.requests = 0
+		stats.successes = 0
+	}
+}
+
+// eject takes the backend out of the balancing, unless the max ejection percent was reached
+func (od *OutlierDetector) eject(backends []*Backend, b *Backend) {
+	if b.IsEjected() {
+		return
+	}
+
+	var ejected int
+	for _, backend := range backends {
+		if backend.IsEjected() {
+			ejected++
+		}
+	}
+	if ejected > 0 && (ejected+1)*100 > od.config.MaxEjectionPercent*len(backends) {
+		return
+	}
+
+	stats := od.statsOf(b)
+	duration := od.config.BaseEjectionTime * time.Duration(1<<stats.ejections)
+	if duration > od.config.MaxEjectionTime || duration <= 0 {
+		duration = od.config.MaxEjectionTime
+	} else {
+		stats.ejections++
+	}
+	stats.consecutive5xx = 0
+	stats.consecutiveGatewayFailure = 0
+
+	b.eject(time.Now().Add(duration))
+	log.Warn().Str("prefix", b.ServicePrefix).Str("server", b.URL.String()).Dur("duration", duration).Msg("Server ejected by outlier detection.")
+}
+
+// isGatewayFailure returns true when the backend couldn't be reached or answered as a gateway error
+func isGatewayFailure(statusCode int, err error) bool {
+	return err != nil || statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
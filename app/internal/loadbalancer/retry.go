@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const (
+	RetryOnConnectFailure = "connect-failure"
+	RetryOnTimeout        = "timeout"
+
+	DefaultRetryMaxAttempts          = 1
+	DefaultRetryBackoffMax           = time.Second
+	DefaultRetryMaxBufferedBodyBytes = 64 * 1024
+)
+
+// RetryPolicy tells when a failed attempt is retried on another backend of the pool
+type RetryPolicy struct {
+	maxAttempts          int
+	backoffBase          time.Duration
+	backoffMax           time.Duration
+	retryOn              map[string]bool
+	retriableStatusCodes map[int]bool
+	retryNonIdempotent   bool
+	maxBufferedBodyBytes int64
+}
+
+func NewRetryPolicy(retryConfig config.Retry) *RetryPolicy {
+	rp := &RetryPolicy{
+		maxAttempts:          retryConfig.MaxAttempts,
+		backoffBase:          retryConfig.BackoffBase,
+		backoffMax:           retryConfig.BackoffMax,
+		retryOn:              make(map[string]bool),
+		retriableStatusCodes: make(map[int]bool),
+		retryNonIdempotent:   retryConfig.RetryNonIdempotent,
+		maxBufferedBodyBytes: retryConfig.MaxBufferedBodyBytes,
+	}
+	if rp.maxAttempts <= 0 {
+		rp.maxAttempts = DefaultRetryMaxAttempts
+	}
+	if rp.backoffBase <= 0 {
+		rp.backoffBase = BackoffTimeout
+	}
+	if rp.backoffMax < rp.backoffBase {
+		rp.backoffMax = DefaultRetryBackoffMax
+	}
+	if rp.maxBufferedBodyBytes <= 0 {
+		rp.maxBufferedBodyBytes = DefaultRetryMaxBufferedBodyBytes
+	}
+
+	retryOn := retryConfig.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{RetryOnConnectFailure}
+	}
+	for _, condition := range retryOn {
+		rp.retryOn[condition] = true
+	}
+	for _, statusCode := range retryConfig.RetriableStatusCodes {
+		rp.retriableStatusCodes[statusCode] = true
+	}
+	return rp
+}
+
+// Attempts returns how many attempts the request can take. Only idempotent methods are retried, unless the retries
+// of non idempotent methods are enabled. gRPC calls are never retried, since their bodies have no length and are
+// streamed (see RequestBody).
+func (rp *RetryPolicy) Attempts(r *http.Request) int {
+	if !rp.retryNonIdempotent && !isIdempotent(r.Method) {
+		return 1
+	}
+	return rp.maxAttempts
+}
+
+// ShouldRetry returns true when the result of the attempt matches a retry condition
+func (rp *RetryPolicy) ShouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return (rp.retryOn[RetryOnTimeout] && isTimeout(err)) || (rp.retryOn[RetryOnConnectFailure] && isConnectFailure(err))
+	}
+	return rp.retriableStatusCodes[resp.StatusCode]
+}
+
+// Backoff returns the wait before the retry, growing exponentially up to the max backoff with jitter
+func (rp *RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := rp.backoffBase << uint(retry-1)
+	if backoff > rp.backoffMax || backoff <= 0 {
+		backoff = rp.backoffMax
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// RequestBody returns the body of each attempt and the attempts that the body allows. The body is buffered
+// so the retries can replay it. Bodies larger than the max buffered body bytes or without length (gRPC and
+// chunked streams, which may wait the response to send more) are streamed as they arrive, without retries.
+func (rp *RetryPolicy) RequestBody(r *http.Request, attempts int) (func() io.Reader, int, error) {
+	if attempts <= 1 || r.Body == nil || r.Body == http.NoBody {
+		return func() io.Reader { return r.Body }, attempts, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > rp.maxBufferedBodyBytes {
+		return func() io.Reader { return r.Body }, 1, nil
+	}
+
+	buffered, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	if err != nil {
+		return nil, 0, err
+	}
+	return func() io.Reader { return bytes.NewReader(buffered) }, attempts, nil
+}
+
+// sleep waits the duration, returning false when the request is done before
+func sleep(ctx context.Context, duration time.Duration) bool {
+	t := time.NewTimer(duration)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
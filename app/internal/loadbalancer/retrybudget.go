@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const (
+	DefaultRetryBudgetPercent             = 20
+	DefaultRetryBudgetMinRetriesPerSecond = 10
+	DefaultRetryBudgetTTL                 = 10 * time.Second
+)
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// RetryBudget limits the retries of a pool to a percent of the recent requests, so retries don't multiply
+// the load when the whole pool degrades. A minimum of retries per second is always allowed for low traffic.
+type RetryBudget struct {
+	percent             float64
+	minRetriesPerSecond int
+	buckets             []budgetBucket
+	mux                 sync.Mutex
+}
+
+func NewRetryBudget(budgetConfig config.RetryBudget) *RetryBudget {
+	percent := budgetConfig.Percent
+	if percent <= 0 {
+		percent = DefaultRetryBudgetPercent
+	}
+	minRetriesPerSecond := budgetConfig.MinRetriesPerSecond
+	if minRetriesPerSecond <= 0 {
+		minRetriesPerSecond = DefaultRetryBudgetMinRetriesPerSecond
+	}
+	ttl := budgetConfig.TTL
+	if ttl < time.Second {
+		ttl = DefaultRetryBudgetTTL
+	}
+	return &RetryBudget{percent: percent, minRetriesPerSecond: minRetriesPerSecond, buckets: make([]budgetBucket, int(ttl/time.Second))}
+}
+
+// OnRequest records an original request into the budget
+func (rb *RetryBudget) OnRequest() {
+	rb.mux.Lock()
+	rb.bucket(time.Now().Unix()).requests++
+	rb.mux.Unlock()
+}
+
+// TryRetry takes a retry from the budget, returning false when it's exhausted
+func (rb *RetryBudget) TryRetry() bool {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+
+	now := time.Now().Unix()
+	var requests, retries int
+	for _, bucket := range rb.buckets {
+		if now-bucket.second < int64(len(rb.buckets)) {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowed := int(float64(requests) * rb.percent / 100)
+	if floor := rb.minRetriesPerSecond * len(rb.buckets); allowed < floor {
+		allowed = floor
+	}
+	if retries >= allowed {
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket of the second, clearing it when it holds an older second
+func (rb *RetryBudget) bucket(second int64) *budgetBucket {
+	bucket := &rb.buckets[second%int64(len(rb.buckets))]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
@@ -0,0 +1,103 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+)
+
+const (
+	RewriteStripPrefix   = "strip_prefix"
+	RewriteReplacePrefix = "replace_prefix"
+	RewriteRegex         = "regex"
+)
+
+// NormalizePath cleans the path of the client, removing the empty and . segments. Paths with .. segments are rejected,
+// so they can't reach paths out of the service.
+func NormalizePath(path string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			return "", errApp.NewBadRequestError(fmt.Sprintf("Path \"%s\" can't have .. segments", path))
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	normalized := "/" + strings.Join(segments, "/")
+	if len(segments) > 0 && strings.HasSuffix(path, "/") {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
+type rewriteRule struct {
+	kind        string
+	match       string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// Rewriter rewrites the paths of a pool to the paths of the backends
+type Rewriter struct {
+	rules    []rewriteRule
+	basePath string
+}
+
+func NewRewriter(rewriteConfig config.Rewrite) (*Rewriter, error) {
+	rw := &Rewriter{basePath: strings.TrimSuffix(rewriteConfig.BasePath, "/")}
+	if rw.basePath != "" && !strings.HasPrefix(rw.basePath, "/") {
+		rw.basePath = "/" + rw.basePath
+	}
+	for _, ruleConfig := range rewriteConfig.Rules {
+		rule := rewriteRule{kind: ruleConfig.Type, match: ruleConfig.Match, replacement: ruleConfig.Replacement}
+		switch ruleConfig.Type {
+		case RewriteStripPrefix, RewriteReplacePrefix:
+			rule.match = strings.TrimSuffix(rule.match, "/")
+		case RewriteRegex:
+			regex, err := regexp.Compile(ruleConfig.Match)
+			if err != nil {
+				return nil, errApp.NewGenericError(fmt.Sprintf("Invalid rewrite regex \"%s\"", ruleConfig.Match), err)
+			}
+			rule.regex = regex
+		default:
+			return nil, errApp.NewGenericError(fmt.Sprintf("Unknown rewrite type \"%s\"", ruleConfig.Type), nil)
+		}
+		rw.rules = append(rw.rules, rule)
+	}
+	return rw, nil
+}
+
+// hasPathPrefix returns true when the path starts with the prefix on a segment boundary (/v1 matches /v1/users, not /v10)
+func hasPathPrefix(path string, prefix string) bool {
+	return strings.HasPrefix(path, prefix) && (len(path) == len(prefix) || path[len(prefix)] == '/' || strings.HasSuffix(prefix, "/"))
+}
+
+// Rewrite applies the rules in order and prepends the base path
+func (rw *Rewriter) Rewrite(path string) string {
+	for _, rule := range rw.rules {
+		switch rule.kind {
+		case RewriteStripPrefix:
+			if hasPathPrefix(path, rule.match) {
+				path = path[len(rule.match):]
+			}
+		case RewriteReplacePrefix:
+			if hasPathPrefix(path, rule.match) {
+				path = strings.TrimSuffix(rule.replacement, "/") + path[len(rule.match):]
+			}
+		case RewriteRegex:
+			path = rule.regex.ReplaceAllString(path, rule.replacement)
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rw.basePath != "" {
+		path = rw.basePath + path
+	}
+	return path
+}
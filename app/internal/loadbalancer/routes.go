@@ -0,0 +1,193 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ortisan/router-go/internal/config"
+	errApp "github.com/ortisan/router-go/internal/error"
+)
+
+const (
+	RoutePathExact  = "exact"
+	RoutePathPrefix = "prefix"
+	RoutePathRegex  = "regex"
+)
+
+// valueMatcher matches a header or query parameter by the exact value, the regex, or only by its presence
+type valueMatcher struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+func newValueMatcher(valueConfig config.RouteValue) (valueMatcher, error) {
+	m := valueMatcher{name: valueConfig.Name, value: valueConfig.Value}
+	if valueConfig.Regex != "" {
+		regex, err := regexp.Compile(valueConfig.Regex)
+		if err != nil {
+			return m, errApp.NewGenericError(fmt.Sprintf("Invalid route regex \"%s\"", valueConfig.Regex), err)
+		}
+		m.regex = regex
+	}
+	return m, nil
+}
+
+func (m valueMatcher) match(values []string) bool {
+	for _, value := range values {
+		if m.regex != nil {
+			if m.regex.MatchString(value) {
+				return true
+			}
+		} else if m.value == "" || m.value == value {
+			return true
+		}
+	}
+	return false
+}
+
+type route struct {
+	hosts         []string
+	pathType      string
+	path          string
+	pathRegex     *regexp.Regexp
+	methods       map[string]bool
+	headers       []valueMatcher
+	query         []valueMatcher
+	servicePrefix string
+}
+
+// RouteTable sends the requests to the pool of the first route they match
+type RouteTable struct {
+	routes []*route
+}
+
+func NewRouteTable(routesConfig []config.Route) (*RouteTable, error) {
+	rt := &RouteTable{}
+	for _, routeConfig := range routesConfig {
+		if routeConfig.ServicePrefix == "" {
+			return nil, errApp.NewGenericError("Route without service prefix", nil)
+		}
+		rule := &route{pathType: routeConfig.Path.Type, path: routeConfig.Path.Value, methods: make(map[string]bool), servicePrefix: routeConfig.ServicePrefix}
+		for _, host := range routeConfig.Hosts {
+			rule.hosts = append(rule.hosts, strings.ToLower(host))
+		}
+		switch routeConfig.Path.Type {
+		case "", RoutePathExact, RoutePathPrefix:
+		case RoutePathRegex:
+			regex, err := regexp.Compile(routeConfig.Path.Value)
+			if err != nil {
+				return nil, errApp.NewGenericError(fmt.Sprintf("Invalid route regex \"%s\"", routeConfig.Path.Value), err)
+			}
+			rule.pathRegex = regex
+		default:
+			return nil, errApp.NewGenericError(fmt.Sprintf("Unknown route path type \"%s\"", routeConfig.Path.Type), nil)
+		}
+		for _, method := range routeConfig.Methods {
+			rule.methods[strings.ToUpper(method)] = true
+		}
+		for _, headerConfig := range routeConfig.Headers {
+			m, err := newValueMatcher(headerConfig)
+			if err != nil {
+				return nil, err
+			}
+			m.name = http.CanonicalHeaderKey(m.name)
+			rule.headers = append(rule.headers, m)
+		}
+		for _, queryConfig := range routeConfig.Query {
+			m, err := newValueMatcher(queryConfig)
+			if err != nil {
+				return nil, err
+			}
+			rule.query = append(rule.query, m)
+		}
+		rt.routes = append(rt.routes, rule)
+	}
+	return rt, nil
+}
+
+// requestHost returns the host of the request, without the port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func (rule *route) match(r *http.Request, path string) bool {
+	if len(rule.hosts) > 0 {
+		host, matched := requestHost(r), false
+		for _, allowed := range rule.hosts {
+			if matchWildcard(allowed, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	switch rule.pathType {
+	case RoutePathExact:
+		if path != rule.path {
+			return false
+		}
+	case RoutePathPrefix:
+		if !hasPathPrefix(path, rule.path) {
+			return false
+		}
+	case RoutePathRegex:
+		if !rule.pathRegex.MatchString(path) {
+			return false
+		}
+	}
+	if len(rule.methods) > 0 && !rule.methods[r.Method] {
+		return false
+	}
+	for _, m := range rule.headers {
+		if !m.match(r.Header.Values(m.name)) {
+			return false
+		}
+	}
+	if len(rule.query) > 0 {
+		query := r.URL.Query()
+		for _, m := range rule.query {
+			if !m.match(query[m.name]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Match returns the service prefix of the first route that matches the request with the normalized path
+func (rt *RouteTable) Match(r *http.Request, path string) (string, bool) {
+	for _, route := range rt.routes {
+		if route.match(r, path) {
+			return route.servicePrefix, true
+		}
+	}
+	return "", false
+}
+
+// ServicePath returns the path of the service for a request routed by the table: the path after /api/{prefix}
+// when it has the prefix of the route, like the routes by prefix, or the whole path otherwise. The rewrite rules
+// and the streaming paths of the pool apply to this path.
+func ServicePath(servicePrefix string, path string) string {
+	apiPrefix := "/api/" + servicePrefix
+	if !hasPathPrefix(path, apiPrefix) {
+		return path
+	}
+	return path[len(apiPrefix):]
+}
+
+// Empty returns true when there isn't any route, so the requests are routed only by prefix
+func (rt *RouteTable) Empty() bool {
+	return len(rt.routes) == 0
+}
+
+var RouteTableObj = &RouteTable{}
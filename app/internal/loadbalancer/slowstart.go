@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"math"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const (
+	DefaultSlowStartMinWeightFraction = 0.1
+	DefaultSlowStartAggression        = 1.0
+)
+
+// SlowStart ramps up the share of traffic of the backends that were just added or recovered,
+// so cold instances aren't taken down again by a full share of requests
+type SlowStart struct {
+	window            time.Duration
+	minWeightFraction float64
+	aggression        float64
+}
+
+func NewSlowStart(slowStartConfig config.SlowStart) *SlowStart {
+	minWeightFraction := slowStartConfig.MinWeightFraction
+	if minWeightFraction <= 0 || minWeightFraction > 1 {
+		minWeightFraction = DefaultSlowStartMinWeightFraction
+	}
+	aggression := slowStartConfig.Aggression
+	if aggression <= 0 {
+		aggression = DefaultSlowStartAggression
+	}
+	return &SlowStart{window: slowStartConfig.Window, minWeightFraction: minWeightFraction, aggression: aggression}
+}
+
+// Factor returns the fraction of the weight that the backend takes now. It grows from the min weight fraction
+// to 1 during the window as (elapsed / window) ^ (1 / aggression), linear with aggression 1.
+func (ss *SlowStart) Factor(b *Backend) float64 {
+	elapsed := time.Since(b.UpSince())
+	if elapsed >= ss.window {
+		return 1
+	}
+	factor := math.Pow(float64(elapsed)/float64(ss.window), 1/ss.aggression)
+	return math.Max(ss.minWeightFraction, factor)
+}
+
+// Warmed returns the backends out of the slow start window
+func (ss *SlowStart) Warmed(backends []*Backend) []*Backend {
+	var warmed []*Backend
+	for _, b := range backends {
+		if ss.Factor(b) >= 1 {
+			warmed = append(warmed, b)
+		}
+	}
+	return warmed
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const DefaultStickyCookieName = "router-affinity"
+
+// StickySession pins the clients to a backend with an affinity cookie. The cookie value is
+// a signature of the backend, so clients can't choose arbitrary servers.
+type StickySession struct {
+	config config.StickySession
+	secret []byte
+}
+
+// NewStickySession returns the sticky session of the prefix. The default cookie name has the prefix
+// (router-affinity-<prefix>), so the cookies of the prefixes don't overwrite each other.
+func NewStickySession(servicePrefix string, stickyConfig config.StickySession) *StickySession {
+	if stickyConfig.CookieName == "" {
+		stickyConfig.CookieName = DefaultStickyCookieName + "-" + servicePrefix
+	}
+	if stickyConfig.Path == "" {
+		stickyConfig.Path = "/"
+	}
+
+	secret := []byte(stickyConfig.Secret)
+	if len(secret) == 0 {
+		log.Warn().Msg("Sticky session without secret, the affinity cookies will be valid only for this router instance.")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &StickySession{config: stickyConfig, secret: secret}
+}
+
+// value returns the signature of the backend used as cookie value
+func (s *StickySession) value(b *Backend) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(b.ServicePrefix + "|" + b.URL.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Backend returns the backend pinned by the affinity cookie of the request, if it's still between the given backends
+func (s *StickySession) Backend(r *http.Request, backends []*Backend) *Backend {
+	cookie, err := r.Cookie(s.config.CookieName)
+	if err != nil {
+		return nil
+	}
+	for _, b := range backends {
+		if hmac.Equal([]byte(cookie.Value), []byte(s.value(b))) {
+			return b
+		}
+	}
+	return nil
+}
+
+// SetCookie pins the client to the backend, unless the request is already pinned to it
+func (s *StickySession) SetCookie(w http.ResponseWriter, r *http.Request, b *Backend) {
+	value := s.value(b)
+	if cookie, err := r.Cookie(s.config.CookieName); err == nil && cookie.Value == value {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.config.CookieName,
+		Value:    value,
+		Path:     s.config.Path,
+		Domain:   s.config.Domain,
+		MaxAge:   int(s.config.TTL.Seconds()),
+		Secure:   s.config.Secure,
+		HttpOnly: s.config.HttpOnly,
+		SameSite: sameSite(s.config.SameSite),
+	})
+}
+
+func sameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteDefaultMode
+	}
+}
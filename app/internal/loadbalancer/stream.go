@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+const StreamBufferSize = 32 * 1024
+
+// bufferPool reuses the buffers of the copies, so the memory of a request is bounded by one buffer
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, StreamBufferSize)
+		return &buffer
+	},
+}
+
+// copyHeader adds all values of the source headers to the destination
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// announceTrailers declares the trailers of the response before the header is written
+func announceTrailers(header http.Header, trailer http.Header) map[string]bool {
+	announced := make(map[string]bool, len(trailer))
+	for name := range trailer {
+		announced[name] = true
+		header.Add("Trailer", name)
+	}
+	return announced
+}
+
+// copyTrailers sets the trailers received after the body. Trailers that weren't announced use the trailer prefix.
+func copyTrailers(header http.Header, trailer http.Header, announced map[string]bool) {
+	for name, values := range trailer {
+		if !announced[name] {
+			name = http.TrailerPrefix + name
+		}
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+// streamBody copies the body to the writer with a pooled buffer, flushing every chunk when flush is true
+func streamBody(w io.Writer, body io.Reader, flush bool) (int64, error) {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+
+	flusher, canFlush := w.(http.Flusher)
+	var written int64
+	for {
+		n, readErr := body.Read(*buffer)
+		if n > 0 {
+			m, writeErr := w.Write((*buffer)[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if flush && canFlush {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
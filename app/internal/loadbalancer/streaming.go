@@ -0,0 +1,190 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const DefaultStreamIdleTimeout = 60 * time.Second
+
+// Streaming tells which responses are streamed: the event streams (SSE) and the responses of the streaming paths
+// (long-poll, chunked feeds), which don't wait the response headers with the timeouts of the requests
+type Streaming struct {
+	paths       []string
+	idleTimeout time.Duration
+}
+
+func NewStreaming(streamingConfig config.Streaming) *Streaming {
+	idleTimeout := streamingConfig.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultStreamIdleTimeout
+	}
+	return &Streaming{paths: streamingConfig.Paths, idleTimeout: idleTimeout}
+}
+
+// Route returns true when the path of the service is streamed
+func (st *Streaming) Route(pathUri string) bool {
+	for _, path := range st.paths {
+		if strings.HasPrefix(pathUri, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEventStream(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+// requestDeadline is the context of a request, canceled when the overall timeout elapses. Streams stop the
+// overall timeout and are canceled when no data arrives within the idle timeout instead.
+type requestDeadline struct {
+	parent      context.Context
+	done        chan struct{}
+	err         error
+	deadline    time.Time
+	timer       *time.Timer
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	mux         sync.Mutex
+}
+
+// newRequestDeadline returns the context of the request, without overall timeout when it's zero
+func newRequestDeadline(parent context.Context, timeout time.Duration) *requestDeadline {
+	d := &requestDeadline{parent: parent, done: make(chan struct{})}
+	if timeout > 0 {
+		d.deadline = time.Now().Add(timeout)
+		d.timer = time.AfterFunc(timeout, func() { d.finish(context.DeadlineExceeded) })
+	}
+	go func() {
+		select {
+		case <-parent.Done():
+			d.finish(parent.Err())
+		case <-d.done:
+		}
+	}()
+	return d
+}
+
+func (d *requestDeadline) Deadline() (time.Time, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.deadline, !d.deadline.IsZero()
+}
+
+func (d *requestDeadline) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *requestDeadline) Err() error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.err
+}
+
+func (d *requestDeadline) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// finish cancels the context with the error, once
+func (d *requestDeadline) finish(err error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.err != nil {
+		return
+	}
+	d.err = err
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+	}
+	close(d.done)
+}
+
+// cancel ends the request
+func (d *requestDeadline) cancel() {
+	d.finish(context.Canceled)
+}
+
+// stream stops the overall timeout, ending the request when it's idle instead
+func (d *requestDeadline) stream(idleTimeout time.Duration) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.err != nil {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.deadline = time.Time{}
+	if d.idleTimer == nil {
+		d.idleTimeout = idleTimeout
+		d.idleTimer = time.AfterFunc(idleTimeout, func() { d.finish(context.DeadlineExceeded) })
+	}
+}
+
+// touch restarts the idle timeout of a stream
+func (d *requestDeadline) touch() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.idleTimer != nil && d.err == nil {
+		d.idleTimer.Reset(d.idleTimeout)
+	}
+}
+
+// idleReader restarts the idle timeout of the stream every time data arrives
+type idleReader struct {
+	io.Reader
+	deadline *requestDeadline
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.deadline.touch()
+	}
+	return n, err
+}
+
+// StreamRegistry holds the open streams, so they are closed when the router stops
+type StreamRegistry struct {
+	streams map[*requestDeadline]bool
+	closed  bool
+	mux     sync.Mutex
+}
+
+var Streams = &StreamRegistry{streams: make(map[*requestDeadline]bool)}
+
+func (sr *StreamRegistry) add(d *requestDeadline) {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	if sr.closed {
+		d.cancel()
+		return
+	}
+	sr.streams[d] = true
+}
+
+func (sr *StreamRegistry) remove(d *requestDeadline) {
+	sr.mux.Lock()
+	delete(sr.streams, d)
+	sr.mux.Unlock()
+}
+
+// Close ends the open streams and the ones that start after it
+func (sr *StreamRegistry) Close() {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	sr.closed = true
+	for d := range sr.streams {
+		d.cancel()
+	}
+}
@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ortisan/router-go/internal/config"
+	"github.com/ortisan/router-go/internal/constant"
+)
+
+const (
+	DefaultConnectTimeout        = 2 * time.Second
+	DefaultResponseHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout           = 90 * time.Second
+	DefaultRequestTimeout        = 30 * time.Second
+	DefaultHealthCheckTimeout    = 2 * time.Second
+)
+
+// Timeouts of the calls to the backends of a pool
+type Timeouts struct {
+	Connect        time.Duration
+	ResponseHeader time.Duration
+	Idle           time.Duration
+	Request        time.Duration
+	HealthCheck    time.Duration
+}
+
+func NewTimeouts(timeoutsConfig config.Timeouts) Timeouts {
+	t := Timeouts{
+		Connect:        timeoutsConfig.Connect,
+		ResponseHeader: timeoutsConfig.ResponseHeader,
+		Idle:           timeoutsConfig.Idle,
+		Request:        timeoutsConfig.Request,
+		HealthCheck:    timeoutsConfig.HealthCheck,
+	}
+	if t.Connect <= 0 {
+		t.Connect = DefaultConnectTimeout
+	}
+	if t.ResponseHeader <= 0 {
+		t.ResponseHeader = DefaultResponseHeaderTimeout
+	}
+	if t.Idle <= 0 {
+		t.Idle = DefaultIdleTimeout
+	}
+	if t.Request <= 0 {
+		t.Request = DefaultRequestTimeout
+	}
+	if t.HealthCheck <= 0 {
+		t.HealthCheck = DefaultHealthCheckTimeout
+	}
+	return t
+}
+
+// RequestTimeout returns the overall timeout of the request, or the deadline sent by the client when it's shorter.
+// gRPC calls have the deadline of the client (grpc-timeout) instead, and no timeout without it, so streams can
+// last longer than the pool timeout.
+func (t Timeouts) RequestTimeout(r *http.Request) time.Duration {
+	if IsGrpc(r.Header) {
+		grpcTimeout, _ := parseGrpcTimeout(r.Header.Get(GrpcTimeoutHeaderName))
+		return grpcTimeout
+	}
+	timeout := t.Request
+	if ms, err := strconv.ParseInt(r.Header.Get(constant.DeadlineHeaderName), 10, 64); err == nil && ms > 0 {
+		if clientTimeout := time.Duration(ms) * time.Millisecond; clientTimeout < timeout {
+			timeout = clientTimeout
+		}
+	}
+	return timeout
+}
+
+// setDeadlineHeader tells the backend how many milliseconds remain to answer, with the gRPC timeout too for gRPC calls
+func setDeadlineHeader(ctx context.Context, header http.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 1 {
+		remaining = 1
+	}
+	header.Set(constant.DeadlineHeaderName, strconv.FormatInt(remaining, 10))
+	if IsGrpc(header) {
+		header.Set(GrpcTimeoutHeaderName, formatGrpcTimeout(time.Duration(remaining)*time.Millisecond))
+	}
+}
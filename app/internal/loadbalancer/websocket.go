@@ -0,0 +1,379 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	errApp "github.com/ortisan/router-go/internal/error"
+	"github.com/ortisan/router-go/internal/telemetry"
+)
+
+const (
+	DefaultTunnelIdleTimeout = 5 * time.Minute
+	DefaultTunnelMaxDuration = 24 * time.Hour
+	DrainPollInterval        = 100 * time.Millisecond
+	CloseFrameTimeout        = time.Second
+	CloseGoingAway           = 1001
+)
+
+// upgradeType returns the protocol of an upgrade request (like websocket), or empty when it isn't one
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// handleUpgrade sends the upgrade request to a backend of the pool and, when it switches protocols,
+// tunnels the bytes of both connections until one side closes, the tunnel is idle or it lasts too long.
+func (s *ServerPool) handleUpgrade(ctx context.Context, pr *proxyRequest) error {
+	if Tunnels.Draining() {
+		return errApp.NewUnavailableError("Router is shutting down", nil)
+	}
+	peer := s.GetNextBackend(pr.c.Request)
+	if peer == nil {
+		return errApp.NewGenericError("No backend servers was found", nil)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("server", peer.URL.String()), attribute.Bool("upgrade", true))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := s.newUpstreamRequest(ctx, pr, peer)
+	if err != nil {
+		return errApp.NewIntegrationError("Error to create upgrade request", err)
+	}
+	protocol := upgradeType(pr.c.Request.Header)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	peer.startRequest()
+	defer peer.endRequest()
+	peer.CountsRequests.onRequest()
+	resp, err := s.connections.UpgradeClient().Do(req)
+	if err != nil {
+		s.onResult(peer, 0, err)
+		return errApp.NewIntegrationError("Error to call API", err)
+	}
+	s.onResult(peer, resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return s.writeResponse(pr, peer, resp)
+	}
+
+	backendConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(upgradeType(resp.Header), protocol) {
+		resp.Body.Close()
+		return errApp.NewIntegrationError("Backend switched to an unexpected protocol", nil)
+	}
+	defer backendConn.Close()
+
+	clientConn, clientBuffer, err := pr.c.Writer.Hijack()
+	if err != nil {
+		return errApp.NewGenericError("Error to hijack client connection", err)
+	}
+	defer clientConn.Close()
+
+	// Switching protocols response to the client
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+	resp.Body = nil
+	if err := resp.Write(clientBuffer); err != nil {
+		return nil
+	}
+	if err := clientBuffer.Flush(); err != nil {
+		return nil
+	}
+
+	tunnel := newTunnel(clientConn, clientBuffer, backendConn, strings.EqualFold(protocol, "websocket"))
+	Tunnels.add(tunnel)
+	defer Tunnels.remove(tunnel)
+	gauge := telemetry.Tunnels.WithLabelValues(s.ServicePrefix, peer.URL.String())
+	gauge.Inc()
+	defer gauge.Dec()
+
+	log.Debug().Str("server", peer.URL.String()).Str("protocol", protocol).Msg("Tunnel opened.")
+	reason := tunnel.run(s.websocket.IdleTimeout, s.websocket.MaxDuration)
+	log.Debug().Str("server", peer.URL.String()).Str("reason", reason).Msg("Tunnel closed.")
+	return nil
+}
+
+// tunnel copies the bytes between the client and the backend connections
+type tunnel struct {
+	client       net.Conn
+	clientReader *bufio.ReadWriter
+	backend      io.ReadWriteCloser
+	websocket    bool
+	toClient     *frameWriter
+	toBackend    *frameWriter
+	lastActivity int64
+	closed       chan string
+	closeOnce    sync.Once
+}
+
+func newTunnel(client net.Conn, clientReader *bufio.ReadWriter, backend io.ReadWriteCloser, websocket bool) *tunnel {
+	return &tunnel{
+		client:       client,
+		clientReader: clientReader,
+		backend:      backend,
+		websocket:    websocket,
+		toClient:     &frameWriter{w: client, track: websocket},
+		toBackend:    &frameWriter{w: backend, track: websocket},
+		lastActivity: time.Now().UnixNano(),
+		closed:       make(chan string, 1),
+	}
+}
+
+// run tunnels until one side closes or a limit is reached, returning the reason
+func (t *tunnel) run(idleTimeout time.Duration, maxDuration time.Duration) string {
+	go t.copy(t.toBackend, t.clientReader, "client closed")
+	go t.copy(t.toClient, t.backend, "backend closed")
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	maxTimer := time.NewTimer(maxDuration)
+	defer maxTimer.Stop()
+	for {
+		select {
+		case reason := <-t.closed:
+			return reason
+		case <-idle.C:
+			sinceActivity := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+			if sinceActivity >= idleTimeout {
+				t.close("idle timeout")
+				continue
+			}
+			idle.Reset(idleTimeout - sinceActivity)
+		case <-maxTimer.C:
+			t.close("max duration")
+		}
+	}
+}
+
+func (t *tunnel) copy(dst io.Writer, src io.Reader, reason string) {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+	for {
+		n, err := src.Read(*buffer)
+		if n > 0 {
+			atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+			if _, writeErr := dst.Write((*buffer)[:n]); writeErr != nil {
+				t.close(reason)
+				return
+			}
+		}
+		if err != nil {
+			t.close(reason)
+			return
+		}
+	}
+}
+
+// close closes both connections, unblocking the copies
+func (t *tunnel) close(reason string) {
+	t.closeOnce.Do(func() {
+		t.client.Close()
+		t.backend.Close()
+		t.closed <- reason
+	})
+}
+
+// goAway sends the going away close frame to both sides of a WebSocket tunnel, so they know the router is stopping,
+// and closes it
+func (t *tunnel) goAway(reason string) {
+	if t.websocket {
+		done := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				t.toClient.writeClose(CloseGoingAway, false)
+			}()
+			go func() {
+				defer wg.Done()
+				// The router is the client of the backend, so its frames are masked
+				t.toBackend.writeClose(CloseGoingAway, true)
+			}()
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(CloseFrameTimeout):
+		}
+	}
+	t.close(reason)
+}
+
+// frameWriter serializes the writes to a side of the tunnel and, for WebSocket, follows the frames written, so
+// a close frame is only sent between two frames
+type frameWriter struct {
+	w         io.Writer
+	track     bool
+	header    []byte
+	remaining uint64
+	mux       sync.Mutex
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	n, err := fw.w.Write(p)
+	if fw.track {
+		fw.advance(p[:n])
+	}
+	return n, err
+}
+
+// advance consumes the bytes of the frames: the header and then the payload
+func (fw *frameWriter) advance(p []byte) {
+	for len(p) > 0 {
+		if fw.remaining > 0 {
+			n := uint64(len(p))
+			if n > fw.remaining {
+				n = fw.remaining
+			}
+			fw.remaining -= n
+			p = p[n:]
+			continue
+		}
+		fw.header = append(fw.header, p[0])
+		p = p[1:]
+		if size, length := frameHeader(fw.header); size > 0 && len(fw.header) == size {
+			fw.remaining = length
+			fw.header = fw.header[:0]
+		}
+	}
+}
+
+// frameHeader returns the size of the header and the length of the payload, or 0 when the header is incomplete
+func frameHeader(header []byte) (int, uint64) {
+	if len(header) < 2 {
+		return 0, 0
+	}
+	size, length := 2, uint64(header[1]&0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	if len(header) < size {
+		return 0, 0
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:10])
+	}
+	return size, length
+}
+
+// writeClose writes a close frame with the status code when the side isn't in the middle of a frame
+func (fw *frameWriter) writeClose(code uint16, masked bool) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	if fw.remaining > 0 || len(fw.header) > 0 {
+		return
+	}
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	frame := []byte{0x88, byte(len(payload))}
+	if masked {
+		key := make([]byte, 4)
+		if _, err := rand.Read(key); err != nil {
+			return
+		}
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	fw.w.Write(append(frame, payload...))
+}
+
+// TunnelRegistry holds the open tunnels, so the router can drain them when it stops
+type TunnelRegistry struct {
+	tunnels  map[*tunnel]bool
+	draining bool
+	mux      sync.Mutex
+}
+
+var Tunnels = &TunnelRegistry{tunnels: make(map[*tunnel]bool)}
+
+func (tr *TunnelRegistry) add(t *tunnel) {
+	tr.mux.Lock()
+	tr.tunnels[t] = true
+	tr.mux.Unlock()
+}
+
+func (tr *TunnelRegistry) remove(t *tunnel) {
+	tr.mux.Lock()
+	delete(tr.tunnels, t)
+	tr.mux.Unlock()
+}
+
+// Count returns the open tunnels
+func (tr *TunnelRegistry) Count() int {
+	tr.mux.Lock()
+	defer tr.mux.Unlock()
+	return len(tr.tunnels)
+}
+
+// Draining returns true when the router doesn't accept new tunnels
+func (tr *TunnelRegistry) Draining() bool {
+	tr.mux.Lock()
+	defer tr.mux.Unlock()
+	return tr.draining
+}
+
+// Drain stops accepting tunnels and waits the open ones to finish. When the context is done, the remaining ones
+// get the going away close frame and are closed.
+func (tr *TunnelRegistry) Drain(ctx context.Context) {
+	tr.mux.Lock()
+	tr.draining = true
+	tr.mux.Unlock()
+
+	t := time.NewTicker(DrainPollInterval)
+	defer t.Stop()
+	for tr.Count() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			tr.mux.Lock()
+			var wg sync.WaitGroup
+			for open := range tr.tunnels {
+				wg.Add(1)
+				go func(open *tunnel) {
+					defer wg.Done()
+					open.goAway("router shutdown")
+				}(open)
+			}
+			tr.mux.Unlock()
+			wg.Wait()
+			return
+		}
+	}
+}
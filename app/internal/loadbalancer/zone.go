@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"math/rand"
+
+	"github.com/ortisan/router-go/internal/config"
+)
+
+const DefaultMinHealthyFraction = 0.7
+
+// ZoneAwareness prefers the backends of the router zone. When the healthy fraction of the local
+// backends drops below the threshold, the traffic spills over the other zones in proportion.
+type ZoneAwareness struct {
+	localZone          string
+	minHealthyFraction float64
+}
+
+func NewZoneAwareness(localZone string, zoneConfig config.ZoneAware) *ZoneAwareness {
+	minHealthyFraction := zoneConfig.MinHealthyFraction
+	if minHealthyFraction <= 0 || minHealthyFraction > 1 {
+		minHealthyFraction = DefaultMinHealthyFraction
+	}
+	return &ZoneAwareness{localZone: localZone, minHealthyFraction: minHealthyFraction}
+}
+
+// Filter returns the healthy backends that should take the request
+func (z *ZoneAwareness) Filter(backends []*Backend, healthy []*Backend) []*Backend {
+	var totalLocal int
+	for _, b := range backends {
+		if b.ZoneAws == z.localZone {
+			totalLocal++
+		}
+	}
+	if totalLocal == 0 {
+		return healthy
+	}
+
+	var local, remote []*Backend
+	for _, b := range healthy {
+		if b.ZoneAws == z.localZone {
+			local = append(local, b)
+		} else {
+			remote = append(remote, b)
+		}
+	}
+	if len(remote) == 0 {
+		return local
+	}
+	if len(local) == 0 {
+		return remote
+	}
+
+	// Keeps into local zone with probability of healthy fraction / threshold
+	healthyFraction := float64(len(local)) / float64(totalLocal)
+	if healthyFraction >= z.minHealthyFraction || rand.Float64() < healthyFraction/z.minHealthyFraction {
+		return local
+	}
+	return remote
+}
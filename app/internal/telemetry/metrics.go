@@ -0,0 +1,59 @@
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the router, exposed on /metrics
+var (
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "router_circuit_breaker_state",
+		Help: "State of the circuit breaker of the backend (0 closed, 1 half open, 2 open).",
+	}, []string{"prefix", "server"})
+
+	CircuitBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_circuit_breaker_transitions_total",
+		Help: "Transitions of the circuit breaker of the backend.",
+	}, []string{"prefix", "server", "from", "to"})
+
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_retries_total",
+		Help: "Retries of requests to other backend of the pool.",
+	}, []string{"prefix"})
+
+	RetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_retry_budget_exhausted_total",
+		Help: "Retries denied because the retry budget of the pool was exhausted.",
+	}, []string{"prefix"})
+
+	Hedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_hedges_total",
+		Help: "Hedged requests sent to other backend of the pool.",
+	}, []string{"prefix"})
+
+	HedgeBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_hedge_budget_exhausted_total",
+		Help: "Hedges denied because the hedging budget of the pool was exhausted.",
+	}, []string{"prefix"})
+
+	UpstreamConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "router_upstream_connections",
+		Help: "Connections of the pool to the backends by state (open, idle, in_use).",
+	}, []string{"prefix", "state"})
+
+	UpstreamDialErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_upstream_dial_errors_total",
+		Help: "Errors to open connections to the backends of the pool.",
+	}, []string{"prefix"})
+
+	GrpcResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_grpc_responses_total",
+		Help: "gRPC responses of the backends of the pool by status code.",
+	}, []string{"prefix", "code"})
+
+	Tunnels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "router_tunnels",
+		Help: "Open tunnels of upgraded connections (WebSocket) to the backend.",
+	}, []string{"prefix", "server"})
+)
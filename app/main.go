@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ortisan/router-go/internal/api"
@@ -10,8 +14,11 @@ import (
 	"github.com/ortisan/router-go/internal/loadbalancer"
 	"github.com/ortisan/router-go/internal/telemetry"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
+const DefaultShutdownTimeout = 30 * time.Second
+
 // @title Router API
 // @version 2.0
 // @description This is an Router APi that balance requests to healthy service endpoints.
@@ -57,5 +64,31 @@ func main() {
 	r := api.Setup()
 
 	// Running server
-	r.Run(config.ConfigObj.App.ServerAddress) // Listen server
+	srv, err := api.NewServer(r)
+	if err != nil {
+		panic(errApp.NewGenericError("Error to setup server", err))
+	}
+	go func() {
+		if err := api.ListenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			panic(errApp.NewGenericError("Error to run server", err))
+		}
+	}()
+
+	// Graceful shutdown, finishing the requests and tunnels in flight
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Info().Msg("Shutting down server...")
+
+	shutdownTimeout := config.ConfigObj.App.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer shutdownCancel()
+	loadbalancer.Streams.Close()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Err(err).Msg("Error to shutdown server.")
+	}
+	loadbalancer.Tunnels.Drain(shutdownCtx)
 }